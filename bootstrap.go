@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/itzg/mc-server-runner/hub"
+	"go.uber.org/zap"
+)
+
+// Bootstrap files ending with bootstrapTemplateExt are rendered as a Go template and then processed
+// line by line. Lines starting with bootstrapCommentPrefix are ignored and lines starting with
+// bootstrapDirectivePrefix control when the following commands are sent. Every other non-blank line
+// is sent to the server as a command. Other bootstrap files are sent as they are, one command per line.
+const (
+	bootstrapTemplateExt     = ".tmpl"
+	bootstrapCommentPrefix   = "#"
+	bootstrapDirectivePrefix = "@"
+)
+
+// defaultBootstrapWaitTimeout limits how long a wait-for directive waits, unless changed by a timeout directive
+const defaultBootstrapWaitTimeout = 5 * time.Minute
+
+// bootstrapQueueSize bounds the server output queued while bootstrap waits for a line
+const bootstrapQueueSize = 1024 * 1024
+
+// bootstrapStep is either a command to send, a delay or a log line to wait for
+type bootstrapStep struct {
+	command string
+	delay   time.Duration
+	waitFor *regexp.Regexp
+	timeout time.Duration
+}
+
+// bootstrapTemplateData is available to bootstrap templates, such as {{ .Hostname }}
+type bootstrapTemplateData struct {
+	Env      map[string]string
+	Hostname string
+	Now      time.Time
+	// Date is the current date formatted as YYYY-MM-DD
+	Date string
+}
+
+var bootstrapTemplateFuncs = template.FuncMap{
+	// env returns the value of an environment variable, or an empty string when not set
+	"env": os.Getenv,
+	// file returns the content of a file, such as a secret, without its trailing newline
+	"file": func(filename string) (string, error) {
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	},
+}
+
+func renderBootstrap(content []byte) (string, error) {
+	tmpl, err := template.New("bootstrap").
+		Funcs(bootstrapTemplateFuncs).
+		Option("missingkey=error").
+		Parse(string(content))
+	if err != nil {
+		return "", err
+	}
+
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	data := bootstrapTemplateData{
+		Env:      map[string]string{},
+		Hostname: hostname,
+		Now:      now,
+		Date:     now.Format(time.DateOnly),
+	}
+	for _, entry := range os.Environ() {
+		name, value, _ := strings.Cut(entry, "=")
+		data.Env[name] = value
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+// parseBootstrap renders and parses a bootstrap template, so any problems are found before the server
+// starts. Without templated, every non-blank line is a command.
+func parseBootstrap(content []byte, templated bool) ([]bootstrapStep, error) {
+	if !templated {
+		var steps []bootstrapStep
+		for _, line := range strings.Split(string(content), "\n") {
+			line = strings.TrimRight(line, "\r")
+			if strings.TrimSpace(line) != "" {
+				steps = append(steps, bootstrapStep{command: line})
+			}
+		}
+		return steps, nil
+	}
+
+	rendered, err := renderBootstrap(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render bootstrap template: %w", err)
+	}
+
+	var steps []bootstrapStep
+	timeout := defaultBootstrapWaitTimeout
+	for i, line := range strings.Split(rendered, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, bootstrapCommentPrefix) {
+			continue
+		}
+		if !strings.HasPrefix(line, bootstrapDirectivePrefix) {
+			steps = append(steps, bootstrapStep{command: line})
+			continue
+		}
+
+		directive, value, _ := strings.Cut(strings.TrimPrefix(line, bootstrapDirectivePrefix), " ")
+		value = strings.TrimSpace(value)
+		switch directive {
+		case "delay":
+			delay, err := time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid delay: %w", i+1, err)
+			}
+			steps = append(steps, bootstrapStep{delay: delay})
+		case "timeout":
+			timeout, err = time.ParseDuration(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid timeout: %w", i+1, err)
+			}
+		case "wait-for":
+			if value == "" {
+				return nil, fmt.Errorf("line %d: wait-for needs a regex", i+1)
+			}
+			pattern, err := regexp.Compile(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid wait-for regex: %w", i+1, err)
+			}
+			steps = append(steps, bootstrapStep{waitFor: pattern, timeout: timeout})
+		default:
+			return nil, fmt.Errorf("line %d: unknown directive '%s', expected delay, timeout or wait-for", i+1, directive)
+		}
+	}
+	return steps, nil
+}
+
+// hasWait reports if any step needs to watch the server's output
+func hasWait(steps []bootstrapStep) bool {
+	for _, step := range steps {
+		if step.waitFor != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// runBootstrap sends the bootstrap commands to the server, honoring the delay and wait-for directives.
+// The output subscription must have been created before the server started, so no lines are missed.
+// Only output logged after the previous wait-for matched is considered by the next one.
+func runBootstrap(ctx context.Context, steps []bootstrapStep, stdin io.Writer, output *hub.Subscription, logger *zap.Logger) {
+	if output != nil {
+		defer output.Unsubscribe()
+	}
+
+	lines := make(chan string)
+	done := make(chan struct{})
+	defer close(done)
+	if output != nil {
+		go func() {
+			defer close(lines)
+			for {
+				chunk, ok := output.Pop()
+				if !ok {
+					return
+				}
+				select {
+				case lines <- string(chunk.Data):
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	for _, step := range steps {
+		switch {
+		case step.delay > 0:
+			logger.Debug("Bootstrap delaying", zap.Duration("delay", step.delay))
+			select {
+			case <-time.After(step.delay):
+			case <-ctx.Done():
+				return
+			}
+
+		case step.waitFor != nil:
+			logger.Info("Bootstrap waiting for server output", zap.String("regex", step.waitFor.String()))
+			if !waitForLine(ctx, lines, step.waitFor, step.timeout) {
+				if ctx.Err() != nil {
+					return
+				}
+				logger.Warn("Timed out waiting for server output, continuing with bootstrap",
+					zap.String("regex", step.waitFor.String()), zap.Duration("timeout", step.timeout))
+			}
+
+		default:
+			logger.Debug("Sending bootstrap command", zap.String("command", step.command))
+			if _, err := stdin.Write([]byte(step.command + "\n")); err != nil {
+				logger.Error("Failed to write bootstrap content", zap.Error(err))
+				return
+			}
+		}
+	}
+}
+
+func waitForLine(ctx context.Context, lines <-chan string, pattern *regexp.Regexp, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				return false
+			}
+			if pattern.MatchString(line) {
+				return true
+			}
+		case <-timer.C:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
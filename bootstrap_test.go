@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseBootstrap(t *testing.T) {
+	t.Setenv("GREETING", "hello")
+	content := []byte("# not a comment\n\n@delay 5s\nsay {{ .Env.GREETING }}\r\n")
+
+	tests := []struct {
+		name      string
+		templated bool
+		expected  []bootstrapStep
+	}{
+		{"plain", false, []bootstrapStep{
+			{command: "# not a comment"},
+			{command: "@delay 5s"},
+			{command: "say {{ .Env.GREETING }}"},
+		}},
+		{"template", true, []bootstrapStep{
+			{delay: 5 * time.Second},
+			{command: "say hello"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			steps, err := parseBootstrap(content, tt.templated)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(steps) != len(tt.expected) {
+				t.Fatalf("expected %+v, got %+v", tt.expected, steps)
+			}
+			for i := range steps {
+				if steps[i] != tt.expected[i] {
+					t.Errorf("step %d: expected %+v, got %+v", i, tt.expected[i], steps[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseBootstrapDirectives(t *testing.T) {
+	steps, err := parseBootstrap([]byte("@timeout 10s\n@wait-for Done \\(\nwhitelist on\n"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(steps) != 2 || steps[0].waitFor == nil || steps[0].timeout != 10*time.Second || steps[1].command != "whitelist on" {
+		t.Errorf("expected a wait-for with a 10s timeout and then a command, got %+v", steps)
+	}
+
+	for _, invalid := range []string{"@delay soon", "@wait-for", "@wait-for (", "@pause 5s", "{{ .Missing }}"} {
+		if _, err := parseBootstrap([]byte(invalid), true); err == nil {
+			t.Errorf("expected %q to be invalid", invalid)
+		}
+	}
+}
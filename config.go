@@ -0,0 +1,391 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/itzg/go-flagsfiller"
+	"github.com/itzg/mc-server-runner/hub"
+	"github.com/itzg/mc-server-runner/supervisor"
+	"github.com/itzg/mc-server-runner/wsconsole"
+	"gopkg.in/yaml.v3"
+)
+
+// fileEnvSuffix marks an environment variable that names a file containing the value of the
+// variable without the suffix, such as WEBSOCKET_PASSWORD_FILE=/run/secrets/ws-password
+const fileEnvSuffix = "_FILE"
+
+// extraSecretEnvs are variables read directly from the environment, rather than through Args,
+// that should also be settable from a file
+var extraSecretEnvs = []string{"RCON_PASSWORD"}
+
+// envFromFiles records the variables that loadEnvFiles has set, so they can be read again on reload
+var envFromFiles = map[string]bool{}
+
+// configKeyRenamer derives the config file key of an Args field, which is the same as its flag name
+var configKeyRenamer = flagsfiller.KebabRenamer()
+
+// loadEnvFiles sets each supported environment variable from the file named by its _FILE variant.
+// This needs to happen before the flags are filled so the values are treated like any other
+// environment variable. The variables are only set if every file could be read.
+func loadEnvFiles() error {
+	var errs []error
+	envNames := append([]string{}, extraSecretEnvs...)
+	for _, field := range reflect.VisibleFields(reflect.TypeFor[Args]()) {
+		if envName := field.Tag.Get("env"); envName != "" {
+			envNames = append(envNames, envName)
+		}
+	}
+
+	values := map[string]string{}
+	for _, envName := range envNames {
+		filename, ok := os.LookupEnv(envName + fileEnvSuffix)
+		if !ok {
+			continue
+		}
+		if _, exists := os.LookupEnv(envName); exists && !envFromFiles[envName] {
+			errs = append(errs, fmt.Errorf("both %s and %s%s are set, but only one may be used", envName, envName, fileEnvSuffix))
+			continue
+		}
+		content, err := os.ReadFile(filename)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to read %s%s: %w", envName, fileEnvSuffix, err))
+			continue
+		}
+		// Like Docker secrets, ignore the trailing newline most editors add
+		values[envName] = strings.TrimRight(string(content), "\r\n")
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	for envName, value := range values {
+		if err := os.Setenv(envName, value); err != nil {
+			return err
+		}
+		envFromFiles[envName] = true
+	}
+	return nil
+}
+
+// configFileKey reports the key used in the config file for the given field, or false if the
+// field can't be set from the config file
+func configFileKey(field reflect.StructField) (string, bool) {
+	if field.Tag.Get("config") == "-" {
+		return "", false
+	}
+	return configKeyRenamer(field.Name), true
+}
+
+// applyConfigFile fills args from a YAML or TOML config file. Values from the file have the lowest
+// precedence, so are only applied to fields not already set by a flag or environment variable.
+// Any key that doesn't match a field is reported as an error.
+func applyConfigFile(args *Args, flagSet *flag.FlagSet, filename string) error {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return fmt.Errorf("unable to read config file: %w", err)
+	}
+
+	values := map[string]any{}
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".yaml", ".yml", ".json":
+		err = yaml.Unmarshal(content, &values)
+	case ".toml":
+		err = toml.Unmarshal(content, &values)
+	default:
+		return fmt.Errorf("unsupported config file type '%s', expected .yaml, .yml, .json or .toml", filepath.Ext(filename))
+	}
+	if err != nil {
+		return fmt.Errorf("unable to parse config file %s: %w", filename, err)
+	}
+
+	explicitFlags := map[string]bool{}
+	flagSet.Visit(func(f *flag.Flag) {
+		explicitFlags[f.Name] = true
+	})
+
+	fields := map[string]reflect.StructField{}
+	for _, field := range reflect.VisibleFields(reflect.TypeFor[Args]()) {
+		if key, ok := configFileKey(field); ok {
+			fields[key] = field
+		}
+	}
+
+	var errs []error
+	argsValue := reflect.ValueOf(args).Elem()
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		value := values[key]
+		field, ok := fields[key]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown setting", key))
+			continue
+		}
+
+		fieldValue := argsValue.FieldByIndex(field.Index)
+		converted, err := convertConfigValue(value, fieldValue.Type())
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", key, err))
+			continue
+		}
+
+		if explicitFlags[key] {
+			continue
+		}
+		if envName := field.Tag.Get("env"); envName != "" {
+			if _, exists := os.LookupEnv(envName); exists {
+				continue
+			}
+		}
+		fieldValue.Set(converted)
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid config file %s: %w", filename, errors.Join(errs...))
+	}
+	return nil
+}
+
+var durationType = reflect.TypeFor[time.Duration]()
+
+// convertConfigValue converts a decoded YAML or TOML value into the type of an Args field
+func convertConfigValue(value any, target reflect.Type) (reflect.Value, error) {
+	if target == durationType {
+		s, ok := value.(string)
+		if !ok {
+			return reflect.Value{}, fmt.Errorf("expected a duration such as 30s, got %v", value)
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		return reflect.ValueOf(d), nil
+	}
+
+	switch target.Kind() {
+	case reflect.Bool:
+		if b, ok := value.(bool); ok {
+			return reflect.ValueOf(b), nil
+		}
+		return reflect.Value{}, fmt.Errorf("expected true or false, got %v", value)
+
+	case reflect.String:
+		if s, ok := value.(string); ok {
+			return reflect.ValueOf(s), nil
+		}
+		return reflect.Value{}, fmt.Errorf("expected a string, got %v", value)
+
+	case reflect.Int:
+		switch n := value.(type) {
+		case int:
+			return reflect.ValueOf(n), nil
+		case int64:
+			return reflect.ValueOf(int(n)), nil
+		case uint64:
+			return reflect.ValueOf(int(n)), nil
+		}
+		return reflect.Value{}, fmt.Errorf("expected an integer, got %v", value)
+
+	case reflect.Slice:
+		switch v := value.(type) {
+		case string:
+			return reflect.ValueOf(parseListSetting(v)), nil
+		case []any:
+			list := make([]string, 0, len(v))
+			for _, entry := range v {
+				s, ok := entry.(string)
+				if !ok {
+					return reflect.Value{}, fmt.Errorf("expected a list of strings, got %v", entry)
+				}
+				list = append(list, s)
+			}
+			return reflect.ValueOf(list), nil
+		}
+		return reflect.Value{}, fmt.Errorf("expected a list of strings, got %v", value)
+	}
+
+	return reflect.Value{}, fmt.Errorf("unsupported setting type %s", target)
+}
+
+// parseListSetting splits a list given as one string the same way as the flag and environment variable
+func parseListSetting(s string) []string {
+	list := []string{}
+	for _, entry := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == '\n' }) {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			list = append(list, entry)
+		}
+	}
+	return list
+}
+
+// validateArgs checks the effective configuration and returns every problem found, so they can
+// all be reported at once at startup
+func validateArgs(args *Args) error {
+	var errs []error
+
+	for _, setting := range []struct {
+		name  string
+		value int64
+	}{
+		{"stop-duration", int64(args.StopDuration)},
+		{"stop-server-announce-delay", int64(args.StopServerAnnounceDelay)},
+		{"remote-console-history-size", int64(args.RemoteConsoleHistorySize)},
+		{"remote-console-buffer-size", int64(args.RemoteConsoleBufferSize)},
+		{"remote-console-exec-timeout", int64(args.RemoteConsoleExecTimeout)},
+		{"websocket-send-queue-size", int64(args.WebsocketSendQueueSize)},
+		{"login-max-failures", int64(args.LoginMaxFailures)},
+		{"login-lockout-duration", int64(args.LoginLockoutDuration)},
+		{"login-max-lockout-duration", int64(args.LoginMaxLockoutDuration)},
+		{"login-global-max-failures", int64(args.LoginGlobalMaxFailures)},
+		{"ready-timeout", int64(args.ReadyTimeout)},
+		{"watchdog-interval", int64(args.WatchdogInterval)},
+		{"watchdog-timeout", int64(args.WatchdogTimeout)},
+		{"watchdog-overload-threshold", int64(args.WatchdogOverloadThreshold)},
+		{"watchdog-dump-after", int64(args.WatchdogDumpAfter)},
+		{"watchdog-restart-after", int64(args.WatchdogRestartAfter)},
+		{"login-max-sessions-per-ip", int64(args.LoginMaxSessionsPerIP)},
+	} {
+		if setting.value < 0 {
+			errs = append(errs, fmt.Errorf("%s: must not be negative", setting.name))
+		}
+	}
+
+	if args.WebsocketLogBufferSize < 1 {
+		errs = append(errs, errors.New("websocket-log-buffer-size: must be at least 1"))
+	}
+	if args.CrashReportLines < 1 {
+		errs = append(errs, errors.New("crash-report-lines: must be at least 1"))
+	}
+
+	if _, err := hub.ParseOverflowPolicy(args.RemoteConsoleOverflowPolicy); err != nil {
+		errs = append(errs, fmt.Errorf("remote-console-overflow-policy: %w", err))
+	}
+	if _, err := hub.ParseOverflowPolicy(args.WebsocketOverflowPolicy); err != nil {
+		errs = append(errs, fmt.Errorf("websocket-overflow-policy: %w", err))
+	}
+	if _, err := wsconsole.ParseOriginPatterns(args.WebsocketAllowedOrigins); err != nil {
+		errs = append(errs, fmt.Errorf("websocket-allowed-origins: %w", err))
+	}
+
+	if _, err := supervisor.ParseStopEscalation(parseListSetting(args.StopEscalation)); err != nil {
+		errs = append(errs, fmt.Errorf("stop-escalation: %w", err))
+	}
+	if args.JavaMemory != "" && args.JavaMemory != javaMemoryArgs && args.JavaMemory != javaMemoryToolOptions {
+		errs = append(errs, fmt.Errorf("java-memory: unknown mode '%s', expected %s or %s",
+			args.JavaMemory, javaMemoryArgs, javaMemoryToolOptions))
+	}
+	if _, err := parseMemoryHeadroom(args.JavaMemoryHeadroom, 0); err != nil {
+		errs = append(errs, fmt.Errorf("java-memory-headroom: %w", err))
+	}
+	if args.JavaMemoryInitialPercent < 1 || args.JavaMemoryInitialPercent > 100 {
+		errs = append(errs, fmt.Errorf("java-memory-initial-percent: must be from 1 to 100"))
+	}
+	if _, err := parseWebhooks(args.CrashReportWebhooks); err != nil {
+		errs = append(errs, fmt.Errorf("crash-report-webhooks: %w", err))
+	}
+	if _, err := parseServerPrivileges(args); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := parseSignalActions(args.SignalActions); err != nil {
+		errs = append(errs, fmt.Errorf("signal-actions: %w", err))
+	}
+	if _, err := regexp.Compile(args.ReadyLogPattern); err != nil {
+		errs = append(errs, fmt.Errorf("ready-log-pattern: %w", err))
+	}
+	if args.ReadyTimeoutPolicy != readyTimeoutFlush && args.ReadyTimeoutPolicy != readyTimeoutDrop {
+		errs = append(errs, fmt.Errorf("ready-timeout-policy: unknown policy '%s', expected %s or %s",
+			args.ReadyTimeoutPolicy, readyTimeoutFlush, readyTimeoutDrop))
+	}
+
+	if args.WatchdogProbe != watchdogProbeConsole && args.WatchdogProbe != watchdogProbeRcon {
+		errs = append(errs, fmt.Errorf("watchdog-probe: unknown probe '%s', expected %s or %s",
+			args.WatchdogProbe, watchdogProbeConsole, watchdogProbeRcon))
+	}
+	if _, err := regexp.Compile(args.WatchdogProbePattern); err != nil {
+		errs = append(errs, fmt.Errorf("watchdog-probe-pattern: %w", err))
+	}
+	if args.WatchdogInterval > 0 && args.WatchdogTimeout <= 0 {
+		errs = append(errs, errors.New("watchdog-timeout: must be positive when the watchdog is enabled"))
+	}
+	if args.WatchdogInterval > 0 && args.WatchdogRestartAfter > 0 && args.WatchdogStopDuration <= 0 {
+		errs = append(errs, errors.New("watchdog-stop-duration: must be positive when the watchdog restarts the server"))
+	}
+
+	if (args.WebsocketTlsCert == "") != (args.WebsocketTlsKey == "") {
+		errs = append(errs, errors.New("websocket-tls-cert and websocket-tls-key must be set together"))
+	}
+	if args.WebsocketTlsClientCa != "" && args.WebsocketTlsCert == "" {
+		errs = append(errs, errors.New("websocket-tls-client-ca requires websocket-tls-cert and websocket-tls-key"))
+	}
+
+	return errors.Join(errs...)
+}
+
+// redactedValue replaces the value of settings tagged as secret when printing the configuration
+const redactedValue = "<redacted>"
+
+// printConfig writes the effective configuration as YAML, in the same form accepted as a config
+// file, with secrets redacted
+func printConfig(args *Args) ([]byte, error) {
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	argsValue := reflect.ValueOf(args).Elem()
+
+	for _, field := range reflect.VisibleFields(reflect.TypeFor[Args]()) {
+		key, ok := configFileKey(field)
+		if !ok {
+			continue
+		}
+		value := argsValue.FieldByIndex(field.Index).Interface()
+
+		valueNode := &yaml.Node{}
+		switch v := value.(type) {
+		case time.Duration:
+			valueNode.SetString(v.String())
+		case string:
+			if v != "" && field.Tag.Get("secret") == "true" {
+				v = redactedValue
+			}
+			valueNode.SetString(v)
+		case []string:
+			if field.Tag.Get("secret") == "true" {
+				// secret URLs keep their host, so the destinations can still be told apart
+				redacted := make([]string, len(v))
+				for i, entry := range v {
+					redacted[i] = redactURL(entry)
+				}
+				v = redacted
+			}
+			if err := valueNode.Encode(v); err != nil {
+				return nil, fmt.Errorf("unable to encode %s: %w", key, err)
+			}
+		case bool:
+			valueNode.Kind = yaml.ScalarNode
+			valueNode.Tag = "!!bool"
+			valueNode.Value = strconv.FormatBool(v)
+		case int:
+			valueNode.Kind = yaml.ScalarNode
+			valueNode.Tag = "!!int"
+			valueNode.Value = strconv.Itoa(v)
+		default:
+			if err := valueNode.Encode(v); err != nil {
+				return nil, fmt.Errorf("unable to encode %s: %w", key, err)
+			}
+		}
+
+		keyNode := &yaml.Node{}
+		keyNode.SetString(key)
+		doc.Content = append(doc.Content, keyNode, valueNode)
+	}
+
+	return yaml.Marshal(doc)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/itzg/go-flagsfiller"
+	"github.com/itzg/mc-server-runner/wsconsole"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+// runtimeConfig is one generation of the configuration along with the settings parsed from it
+type runtimeConfig struct {
+	args           *Args
+	allowedOrigins []wsconsole.OriginPattern
+	authorizedKeys []gossh.PublicKey
+}
+
+func newRuntimeConfig(args *Args) (*runtimeConfig, error) {
+	if err := validateArgs(args); err != nil {
+		return nil, err
+	}
+
+	allowedOrigins, err := wsconsole.ParseOriginPatterns(args.WebsocketAllowedOrigins)
+	if err != nil {
+		return nil, err
+	}
+	authorizedKeys, err := loadAuthorizedKeys(args.RemoteConsoleAuthorizedKeys)
+	if err != nil {
+		return nil, fmt.Errorf("remote-console-authorized-keys: %w", err)
+	}
+
+	return &runtimeConfig{
+		args:           args,
+		allowedOrigins: allowedOrigins,
+		authorizedKeys: authorizedKeys,
+	}, nil
+}
+
+// liveConfig holds the configuration of the running server. A SIGHUP or the reload API replaces
+// the settings tagged as reloadable, while the rest keep the values the server was started with.
+type liveConfig struct {
+	current atomic.Pointer[runtimeConfig]
+	// reloadMu serializes reloads, since each one updates the environment, and guards listeners
+	reloadMu  sync.Mutex
+	listeners []func(*runtimeConfig)
+	logger    *zap.Logger
+}
+
+func newLiveConfig(args *Args, logger *zap.Logger) (*liveConfig, error) {
+	initial, err := newRuntimeConfig(args)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &liveConfig{logger: logger}
+	c.current.Store(initial)
+	return c, nil
+}
+
+func (c *liveConfig) Get() *runtimeConfig {
+	return c.current.Load()
+}
+
+// OnReload registers a function that is called with the new configuration after each successful reload
+func (c *liveConfig) OnReload(listener func(*runtimeConfig)) {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+
+	c.listeners = append(c.listeners, listener)
+}
+
+// Reload reads the _FILE environment variables, flags and config file again and applies the
+// reloadable settings. If anything is invalid, the previous configuration is kept.
+// It returns the names of the settings that changed.
+func (c *liveConfig) Reload() ([]string, error) {
+	c.reloadMu.Lock()
+	defer c.reloadMu.Unlock()
+
+	previousEnv := map[string]string{}
+	for envName := range envFromFiles {
+		previousEnv[envName] = os.Getenv(envName)
+	}
+	restoreEnv := func() {
+		for envName, value := range previousEnv {
+			_ = os.Setenv(envName, value)
+		}
+	}
+
+	if err := loadEnvFiles(); err != nil {
+		restoreEnv()
+		return nil, err
+	}
+
+	reloaded, err := reparseArgs()
+	if err == nil {
+		err = validateArgs(reloaded)
+	}
+	if err != nil {
+		restoreEnv()
+		return nil, err
+	}
+
+	current := c.Get()
+	merged := *current.args
+	var changed, ignored []string
+	var changeLogs [][]zap.Field
+	mergedValue := reflect.ValueOf(&merged).Elem()
+	reloadedValue := reflect.ValueOf(reloaded).Elem()
+	for _, field := range reflect.VisibleFields(reflect.TypeFor[Args]()) {
+		key := configKeyRenamer(field.Name)
+		oldValue := mergedValue.FieldByIndex(field.Index)
+		newValue := reloadedValue.FieldByIndex(field.Index)
+		if reflect.DeepEqual(oldValue.Interface(), newValue.Interface()) {
+			continue
+		}
+		if field.Tag.Get("reload") != "true" {
+			ignored = append(ignored, key)
+			continue
+		}
+
+		changeLogs = append(changeLogs, []zap.Field{
+			zap.String("setting", key),
+			zap.String("old", describeSetting(field, oldValue)),
+			zap.String("new", describeSetting(field, newValue)),
+		})
+		oldValue.Set(newValue)
+		changed = append(changed, key)
+	}
+	for envName, value := range previousEnv {
+		if os.Getenv(envName) != value {
+			changeLogs = append(changeLogs, []zap.Field{zap.String("env", envName)})
+			changed = append(changed, envName)
+		}
+	}
+
+	next, err := newRuntimeConfig(&merged)
+	if err != nil {
+		restoreEnv()
+		return nil, err
+	}
+	// The authorized keys file may have changed without its name changing
+	if !slices.EqualFunc(current.authorizedKeys, next.authorizedKeys, func(a, b gossh.PublicKey) bool {
+		return bytes.Equal(a.Marshal(), b.Marshal())
+	}) {
+		changeLogs = append(changeLogs, []zap.Field{
+			zap.String("setting", "remote-console-authorized-keys"),
+			zap.Int("keys", len(next.authorizedKeys)),
+		})
+		if !slices.Contains(changed, "remote-console-authorized-keys") {
+			changed = append(changed, "remote-console-authorized-keys")
+		}
+	}
+	for _, fields := range changeLogs {
+		c.logger.Info("Configuration setting changed", fields...)
+	}
+	if len(ignored) > 0 {
+		c.logger.Warn("Some changed settings require a restart and were not applied", zap.Strings("settings", ignored))
+	}
+
+	c.current.Store(next)
+	for _, listener := range c.listeners {
+		listener(next)
+	}
+	return changed, nil
+}
+
+// reparseArgs fills a fresh Args from the command-line flags, environment variables and config file
+// the same way as at startup
+func reparseArgs() (*Args, error) {
+	var args Args
+	flagSet := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	flagSet.SetOutput(io.Discard)
+	if err := flagsfiller.New().Fill(flagSet, &args); err != nil {
+		return nil, err
+	}
+	if err := flagSet.Parse(os.Args[1:]); err != nil {
+		return nil, err
+	}
+	if args.Config != "" {
+		if err := applyConfigFile(&args, flagSet, args.Config); err != nil {
+			return nil, err
+		}
+	}
+	return &args, nil
+}
+
+// describeSetting formats a setting's value for logging, with secrets redacted
+func describeSetting(field reflect.StructField, value reflect.Value) string {
+	if field.Tag.Get("secret") == "true" {
+		if value.IsZero() {
+			return ""
+		}
+		return redactedValue
+	}
+	if list, ok := value.Interface().([]string); ok {
+		return strings.Join(list, ",")
+	}
+	return fmt.Sprint(value.Interface())
+}
+
+// loadAuthorizedKeys reads a file of SSH public keys in authorized_keys format. No file allows no keys.
+func loadAuthorizedKeys(filename string) ([]gossh.PublicKey, error) {
+	if filename == "" {
+		return nil, nil
+	}
+
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []gossh.PublicKey
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, _, _, _, err := gossh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("invalid public key on line %d of %s: %w", i+1, filename, err)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+func authorizedKey(t *testing.T) []byte {
+	t.Helper()
+	public, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := gossh.NewPublicKey(public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gossh.MarshalAuthorizedKey(key)
+}
+
+func TestReloadAuthorizedKeys(t *testing.T) {
+	keysFile := filepath.Join(t.TempDir(), "authorized_keys")
+	if err := os.WriteFile(keysFile, authorizedKey(t), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the reload parses the runner's own command line, so leave out the test flags
+	osArgs := os.Args
+	os.Args = []string{osArgs[0]}
+	t.Cleanup(func() { os.Args = osArgs })
+	t.Setenv("REMOTE_CONSOLE_AUTHORIZED_KEYS", keysFile)
+
+	args, err := reparseArgs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := newLiveConfig(args, zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := config.Get().authorizedKeys; len(keys) != 1 {
+		t.Fatalf("expected 1 authorized key, got %d", len(keys))
+	}
+	var reloaded []gossh.PublicKey
+	config.OnReload(func(current *runtimeConfig) {
+		reloaded = current.authorizedKeys
+	})
+
+	content := append(authorizedKey(t), "# a comment\n"...)
+	content = append(content, authorizedKey(t)...)
+	if err := os.WriteFile(keysFile, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	changed, err := config.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(changed, "remote-console-authorized-keys") {
+		t.Errorf("expected the authorized keys to change, got %v", changed)
+	}
+	if len(reloaded) != 2 {
+		t.Errorf("expected the listeners to get 2 authorized keys, got %d", len(reloaded))
+	}
+
+	if err := os.WriteFile(keysFile, []byte("ssh-ed25519 not-a-key\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := config.Reload(); err == nil {
+		t.Error("expected an invalid authorized keys file to be rejected")
+	}
+	if keys := config.Get().authorizedKeys; len(keys) != 2 {
+		t.Errorf("expected the previous 2 authorized keys to stay in effect, got %d", len(keys))
+	}
+}
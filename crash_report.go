@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/itzg/mc-server-runner/hub"
+	"github.com/itzg/mc-server-runner/supervisor"
+	"github.com/pbnjay/memory"
+	"go.uber.org/zap"
+)
+
+const (
+	crashOomKilled        = "oom-killed"
+	crashOutOfMemory      = "java-out-of-memory"
+	crashStopTimeout      = "stop-timeout"
+	crashSignal           = "signal"
+	crashEulaNotAccepted  = "eula-not-accepted"
+	crashPortInUse        = "port-in-use"
+	crashCorruptedWorld   = "corrupted-world"
+	crashJavaException    = "java-exception"
+	crashWatchdogRestart  = "watchdog-restart"
+	crashUnknown          = "unknown"
+	crashReportsDir       = "crash-reports"
+	crashWebhookTimeout   = 10 * time.Second
+	crashLogDrainTimeout  = 2 * time.Second
+	crashReportQueueSize  = 1024 * 1024
+	crashReportFilePrefix = "mc-server-runner-crash-"
+)
+
+// crashLogPatterns classify an exit by the server's recent output, checked in order
+var crashLogPatterns = []struct {
+	cause   string
+	pattern *regexp.Regexp
+}{
+	{crashEulaNotAccepted, regexp.MustCompile(`You need to agree to the EULA`)},
+	{crashPortInUse, regexp.MustCompile(`(?i)failed to bind to port|address already in use`)},
+	{crashOutOfMemory, regexp.MustCompile(`java\.lang\.OutOfMemoryError`)},
+	{crashCorruptedWorld, regexp.MustCompile(`(?i)failed to load level|exception reading .*level\.dat|couldn't load chunk|chunk file at .* is in the wrong location|region file .* is truncated|corrupt(ed)? (chunk|region|level)`)},
+	{crashJavaException, regexp.MustCompile(`Exception in thread|^\s*(Caused by: )?[a-z][\w$]*(\.[\w$]+)+(Exception|Error)(: |$)|^\s+at [\w$.]+\(`)},
+}
+
+// crashDescriptionPattern finds the description in one of the server's crash-reports files
+var crashDescriptionPattern = regexp.MustCompile(`^Description: (.+)`)
+
+// crashReport describes why the server exited abnormally
+type crashReport struct {
+	Time            time.Time        `json:"time"`
+	ExitCode        int              `json:"exitCode"`
+	Signal          string           `json:"signal,omitempty"`
+	Cause           string           `json:"cause"`
+	Details         string           `json:"details,omitempty"`
+	StateBeforeExit supervisor.State `json:"stateBeforeExit"`
+	Uptime          string           `json:"uptime"`
+	ServerCrashFile string           `json:"serverCrashFile,omitempty"`
+	Memory          crashMemory      `json:"memory"`
+	LogLines        []string         `json:"logLines"`
+}
+
+type crashMemory struct {
+	TotalMB     uint64 `json:"totalMB"`
+	FreeMB      uint64 `json:"freeMB"`
+	LimitMB     uint64 `json:"limitMB"`
+	LimitSource string `json:"limitSource"`
+	// PeakMB is the container's highest memory usage, when the cgroup reports it
+	PeakMB   uint64 `json:"peakMB,omitempty"`
+	OomKills int64  `json:"oomKills"`
+}
+
+// crashReporter keeps the server's recent output so that, when the server exits abnormally,
+// it can classify why and write a report, which is also sent to each webhook
+type crashReporter struct {
+	dir      string
+	webhooks []string
+	logger   *zap.Logger
+
+	lines    *hub.LogRing
+	linesEnd chan struct{}
+	started  time.Time
+	// oomKillsAtStart is the container's OOM kill count before the server started
+	oomKillsAtStart int64
+}
+
+func newCrashReporter(output *hub.Hub, lines int, dir string, webhooks []string, logger *zap.Logger) *crashReporter {
+	r := &crashReporter{
+		dir:             dir,
+		webhooks:        webhooks,
+		logger:          logger,
+		lines:           hub.NewLogRing(lines),
+		linesEnd:        make(chan struct{}),
+		started:         time.Now(),
+		oomKillsAtStart: cgroupOomKills(),
+	}
+
+	sub := output.Subscribe("crash report", crashReportQueueSize, hub.DropOldest)
+	go func() {
+		defer close(r.linesEnd)
+		for {
+			chunk, ok := sub.Pop()
+			if !ok {
+				return
+			}
+			r.lines.Add(strings.TrimRight(string(chunk.Data), "\r\n"))
+		}
+	}()
+	return r
+}
+
+// ReportIfAbnormal writes a crash report when the server exited with a failure, or exited
+// successfully for a known bad reason, such as the EULA not being accepted. The output hub
+// should be closed first, so the report has all the server's output.
+func (r *crashReporter) ReportIfAbnormal(state *os.ProcessState, stateBeforeExit supervisor.State) {
+	select {
+	case <-r.linesEnd:
+	case <-time.After(crashLogDrainTimeout):
+	}
+
+	report := r.build(state, stateBeforeExit)
+	if state.Success() && !unexpectedSuccess(report) {
+		return
+	}
+
+	r.logger.Error("Server exited abnormally",
+		zap.String("cause", report.Cause), zap.String("details", report.Details), zap.Int("exitCode", report.ExitCode))
+
+	content, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		r.logger.Error("Failed to encode crash report", zap.Error(err))
+		return
+	}
+	filename := filepath.Join(r.dir, crashReportFilePrefix+report.Time.Format("20060102-150405")+".json")
+	if err := os.WriteFile(filename, content, 0644); err != nil {
+		r.logger.Error("Failed to write crash report", zap.String("file", filename), zap.Error(err))
+	} else {
+		r.logger.Info("Saved crash report", zap.String("file", filename))
+	}
+
+	for _, webhook := range r.webhooks {
+		if err := postCrashReport(webhook, content); err != nil {
+			r.logger.Error("Failed to send crash report", zap.String("webhook", redactURL(webhook)), zap.Error(err))
+		}
+	}
+}
+
+func (r *crashReporter) build(state *os.ProcessState, stateBeforeExit supervisor.State) *crashReport {
+	now := time.Now()
+	report := &crashReport{
+		Time:            now,
+		ExitCode:        state.ExitCode(),
+		StateBeforeExit: stateBeforeExit,
+		Uptime:          now.Sub(r.started).Round(time.Second).String(),
+		LogLines:        r.lines.Lines(),
+	}
+
+	limit, limitSource := containerMemoryLimit()
+	report.Memory = crashMemory{
+		TotalMB:     memory.TotalMemory() / 1024 / 1024,
+		FreeMB:      memory.FreeMemory() / 1024 / 1024,
+		LimitMB:     limit / 1024 / 1024,
+		LimitSource: limitSource,
+		PeakMB:      cgroupMemoryPeak() / 1024 / 1024,
+		OomKills:    cgroupOomKills() - r.oomKillsAtStart,
+	}
+
+	var signaled syscall.Signal
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		signaled = status.Signal()
+		report.Signal = signalName(signaled)
+	}
+	report.ServerCrashFile, report.Details = r.latestServerCrash()
+
+	// OOM kills and the runner's own knowledge of why the server was stopped come first,
+	// then what the server's output tells
+	switch {
+	case report.Memory.OomKills > 0:
+		report.Cause = crashOomKilled
+		report.Details = fmt.Sprintf("the container's memory limit of %dMB was reached", report.Memory.LimitMB)
+	case stateBeforeExit == supervisor.Killing:
+		report.Cause = crashStopTimeout
+		report.Details = "the server didn't stop in time and was killed"
+	case stateBeforeExit == supervisor.Restarting:
+		report.Cause = crashWatchdogRestart
+		report.Details = "the watchdog stopped the unresponsive server"
+	default:
+		report.Cause = crashUnknown
+		if cause, line := classifyLogLines(report.LogLines); cause != "" {
+			report.Cause = cause
+			if report.ServerCrashFile == "" || cause != crashJavaException {
+				report.Details = line
+			}
+		} else if report.ServerCrashFile != "" {
+			report.Cause = crashJavaException
+		} else if signaled != 0 {
+			report.Cause = crashSignal
+			report.Details = "the server was killed by " + report.Signal
+			if signaled == syscall.SIGKILL {
+				report.Details += ", possibly by the kernel for using too much memory"
+			}
+		}
+	}
+	return report
+}
+
+// unexpectedSuccess reports whether a successful exit was still a problem, such as when the server
+// exited by itself because its EULA wasn't accepted, rather than being stopped
+func unexpectedSuccess(report *crashReport) bool {
+	switch report.StateBeforeExit {
+	case supervisor.Restarting:
+		return true
+	case supervisor.Starting, supervisor.Running, supervisor.Ready:
+		// exceptions logged along the way don't explain an exit unless the server also wrote a crash report
+		return report.Cause != crashUnknown && (report.Cause != crashJavaException || report.ServerCrashFile != "")
+	default:
+		return false
+	}
+}
+
+// latestServerCrash finds a file the server wrote to crash-reports since it started, along with its description
+func (r *crashReporter) latestServerCrash() (string, string) {
+	entries, err := os.ReadDir(crashReportsDir)
+	if err != nil {
+		return "", ""
+	}
+	var latest string
+	var latestTime time.Time
+	for _, entry := range entries {
+		info, err := entry.Info()
+		// file times come from a coarser clock, so allow for them being slightly early
+		if err != nil || entry.IsDir() || info.ModTime().Before(r.started.Add(-time.Second)) {
+			continue
+		}
+		if info.ModTime().After(latestTime) {
+			latest = filepath.Join(crashReportsDir, entry.Name())
+			latestTime = info.ModTime()
+		}
+	}
+	if latest == "" {
+		return "", ""
+	}
+
+	file, err := os.Open(latest)
+	if err != nil {
+		return latest, ""
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if match := crashDescriptionPattern.FindStringSubmatch(scanner.Text()); match != nil {
+			return latest, match[1]
+		}
+	}
+	return latest, ""
+}
+
+// classifyLogLines returns the cause of the first pattern matched by any line, along with that line
+func classifyLogLines(lines []string) (string, string) {
+	for _, candidate := range crashLogPatterns {
+		for _, line := range lines {
+			if candidate.pattern.MatchString(line) {
+				return candidate.cause, strings.TrimSpace(line)
+			}
+		}
+	}
+	return "", ""
+}
+
+func postCrashReport(webhook string, content []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), crashWebhookTimeout)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %s", response.Status)
+	}
+	return nil
+}
+
+// parseWebhooks checks that each webhook is an http or https URL
+func parseWebhooks(webhooks []string) ([]string, error) {
+	var result []string
+	for _, webhook := range webhooks {
+		webhook = strings.TrimSpace(webhook)
+		if webhook == "" {
+			continue
+		}
+		parsed, err := url.Parse(webhook)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return nil, fmt.Errorf("'%s' isn't an http or https URL", redactURL(webhook))
+		}
+		result = append(result, webhook)
+	}
+	return result, nil
+}
+
+// redactURL leaves out the path and query of a webhook URL, which often hold its token
+func redactURL(webhook string) string {
+	parsed, err := url.Parse(webhook)
+	if err != nil || parsed.Host == "" {
+		return redactedValue
+	}
+	return parsed.Scheme + "://" + parsed.Host + "/" + redactedValue
+}
+
+// cgroupOomKills is the number of processes the kernel killed in the container for reaching
+// its memory limit, or 0 when the cgroup doesn't report it
+func cgroupOomKills() int64 {
+	for _, candidate := range cgroupMemoryFiles("memory.events", "memory.oom_control") {
+		content, err := os.ReadFile(candidate.file)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(content), "\n") {
+			if value, found := strings.CutPrefix(line, "oom_kill "); found {
+				count, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+				if err == nil {
+					return count
+				}
+			}
+		}
+	}
+	return 0
+}
+
+// cgroupMemoryPeak is the container's highest memory usage in bytes, or 0 when the cgroup doesn't report it
+func cgroupMemoryPeak() uint64 {
+	for _, candidate := range cgroupMemoryFiles("memory.peak", "memory.max_usage_in_bytes") {
+		content, err := os.ReadFile(candidate.file)
+		if err != nil {
+			continue
+		}
+		peak, err := strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+		if err == nil {
+			return peak
+		}
+	}
+	return 0
+}
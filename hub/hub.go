@@ -0,0 +1,199 @@
+// Package hub fans out a process' stdout and stderr to any number of consumers, such as
+// console sessions, without letting a slow consumer stall the process.
+package hub
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Target is the stream of the process' output
+type Target int32
+
+const (
+	Stdout Target = 0
+	Stderr Target = 1
+)
+
+// Hub fans out the server's stdout and stderr to every consumer of console output.
+//
+// Sinks, such as the runner's own stdout, receive the raw bytes synchronously as the server
+// writes them. Subscribers, such as console sessions, receive the output split into lines, each
+// labeled with its stream, a sequence number and a timestamp. Subscribers each have a bounded
+// queue, so they may come and go at any time and can never block the server's output.
+type Hub struct {
+	logger *zap.Logger
+
+	subscribersMu sync.RWMutex
+	sinks         map[Target][]io.Writer
+	subscribers   map[*Subscription]struct{}
+	// dropped counts the output bytes discarded by subscriptions that fell behind
+	dropped atomic.Uint64
+
+	// linesMu guards the line assembly and sequence numbering
+	linesMu sync.Mutex
+	seq     uint64
+	partial map[Target][]byte
+}
+
+func New(logger *zap.Logger) *Hub {
+	return &Hub{
+		logger:      logger,
+		sinks:       map[Target][]io.Writer{},
+		subscribers: map[*Subscription]struct{}{},
+		partial:     map[Target][]byte{},
+	}
+}
+
+// Subscription receives lines of output from a Hub until unsubscribed
+type Subscription struct {
+	*Queue
+	name string
+	hub  *Hub
+}
+
+// AddSink registers a writer that receives the raw output of the given stream as it is written.
+// Sinks are written synchronously, so should only be used for local destinations like os.Stdout.
+func (h *Hub) AddSink(stream Target, w io.Writer) {
+	h.subscribersMu.Lock()
+	defer h.subscribersMu.Unlock()
+
+	h.sinks[stream] = append(h.sinks[stream], w)
+}
+
+// Subscribe registers a new subscriber that queues up to maxBytes of output, after which
+// the overflow policy applies
+func (h *Hub) Subscribe(name string, maxBytes int, policy OverflowPolicy) *Subscription {
+	sub := &Subscription{
+		Queue: NewQueue(maxBytes, policy),
+		name:  name,
+		hub:   h,
+	}
+	sub.totalDropped = &h.dropped
+
+	h.subscribersMu.Lock()
+	h.subscribers[sub] = struct{}{}
+	h.subscribersMu.Unlock()
+
+	h.logger.Debug("Output subscriber added", zap.String("name", name))
+	return sub
+}
+
+// Unsubscribe stops delivery of further output. Output already queued can still be popped.
+func (s *Subscription) Unsubscribe() {
+	s.hub.subscribersMu.Lock()
+	_, exists := s.hub.subscribers[s]
+	delete(s.hub.subscribers, s)
+	s.hub.subscribersMu.Unlock()
+
+	if exists {
+		s.hub.logger.Debug("Output subscriber removed", zap.String("name", s.name))
+	}
+	s.Close()
+}
+
+// DroppedBytes is the number of output bytes discarded so far by the subscriptions of this hub
+func (h *Hub) DroppedBytes() uint64 {
+	return h.dropped.Load()
+}
+
+// Writer returns the writer to assign as the process' stdout or stderr
+func (h *Hub) Writer(stream Target) io.Writer {
+	return &hubWriter{
+		hub:    h,
+		stream: stream,
+	}
+}
+
+type hubWriter struct {
+	hub    *Hub
+	stream Target
+}
+
+func (w *hubWriter) Write(p []byte) (int, error) {
+	w.hub.write(w.stream, p)
+	return len(p), nil
+}
+
+func (h *Hub) write(stream Target, p []byte) {
+	h.subscribersMu.RLock()
+	sinks := h.sinks[stream]
+	h.subscribersMu.RUnlock()
+
+	for _, sink := range sinks {
+		if _, err := sink.Write(p); err != nil {
+			h.logger.Error("Failed to write server output", zap.Error(err))
+		}
+	}
+
+	h.linesMu.Lock()
+	defer h.linesMu.Unlock()
+
+	data := append(h.partial[stream], p...)
+	for len(data) > 0 {
+		// Publish either the line, including its newline, or the current max run, whichever is hit first.
+		end := bytes.IndexByte(data, '\n') + 1
+		if end == 0 {
+			if len(data) < bufio.MaxScanTokenSize {
+				break
+			}
+			end = len(data)
+		}
+		h.publishLocked(stream, data[:end])
+		data = data[end:]
+	}
+	h.partial[stream] = bytes.Clone(data)
+}
+
+// Flush publishes any incomplete last line, such as when the process has exited
+func (h *Hub) Flush() {
+	h.linesMu.Lock()
+	defer h.linesMu.Unlock()
+
+	for stream, data := range h.partial {
+		if len(data) > 0 {
+			h.publishLocked(stream, data)
+		}
+		delete(h.partial, stream)
+	}
+}
+
+// publishLocked must be called with linesMu held, which keeps the lines in sequence order
+func (h *Hub) publishLocked(stream Target, line []byte) {
+	h.seq++
+	chunk := Chunk{
+		Target: stream,
+		Data:   line,
+		Seq:    h.seq,
+		Time:   time.Now(),
+	}
+
+	h.subscribersMu.RLock()
+	defer h.subscribersMu.RUnlock()
+
+	for sub := range h.subscribers {
+		sub.Push(chunk)
+	}
+}
+
+// Close ends every subscription once the process' output is complete
+func (h *Hub) Close() {
+	h.Flush()
+
+	h.subscribersMu.Lock()
+	subs := make([]*Subscription, 0, len(h.subscribers))
+	for sub := range h.subscribers {
+		subs = append(subs, sub)
+	}
+	h.subscribersMu.Unlock()
+
+	for _, sub := range subs {
+		sub.Unsubscribe()
+	}
+}
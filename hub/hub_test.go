@@ -0,0 +1,104 @@
+package hub
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func TestHubSplitsLines(t *testing.T) {
+	h := New(zap.NewNop())
+	var raw bytes.Buffer
+	h.AddSink(Stdout, &raw)
+	sub := h.Subscribe("test", 0, DropOldest)
+
+	stdout := h.Writer(Stdout)
+	stderr := h.Writer(Stderr)
+	stdout.Write([]byte("first\nsec"))
+	stderr.Write([]byte("error\n"))
+	stdout.Write([]byte("ond\npartial"))
+	h.Close()
+
+	expected := []Chunk{
+		{Target: Stdout, Data: []byte("first\n"), Seq: 1},
+		{Target: Stderr, Data: []byte("error\n"), Seq: 2},
+		{Target: Stdout, Data: []byte("second\n"), Seq: 3},
+		{Target: Stdout, Data: []byte("partial"), Seq: 4},
+	}
+	for _, want := range expected {
+		got, ok := sub.Pop()
+		if !ok {
+			t.Fatalf("expected %q, got the end of output", want.Data)
+		}
+		if got.Target != want.Target || !bytes.Equal(got.Data, want.Data) || got.Seq != want.Seq {
+			t.Errorf("expected %d %q on %d, got %d %q on %d", want.Seq, want.Data, want.Target, got.Seq, got.Data, got.Target)
+		}
+	}
+	if got, ok := sub.Pop(); ok {
+		t.Errorf("expected the end of output, got %q", got.Data)
+	}
+
+	if raw.String() != "first\nsecond\npartial" {
+		t.Errorf("expected the sink to receive the raw stdout, got %q", raw.String())
+	}
+}
+
+func TestHubSplitsLongLines(t *testing.T) {
+	h := New(zap.NewNop())
+	sub := h.Subscribe("test", 0, DropOldest)
+
+	long := strings.Repeat("x", 70*1024)
+	w := h.Writer(Stdout)
+	w.Write([]byte(long))
+	w.Write([]byte("\n"))
+	h.Close()
+
+	var joined []byte
+	chunks := 0
+	for chunk, ok := sub.Pop(); ok; chunk, ok = sub.Pop() {
+		joined = append(joined, chunk.Data...)
+		chunks++
+	}
+	if chunks != 2 || string(joined) != long+"\n" {
+		t.Errorf("expected the long line in 2 chunks, got %d chunks of %d bytes", chunks, len(joined))
+	}
+}
+
+func TestHubCountsDroppedBytesPerHub(t *testing.T) {
+	slow := New(zap.NewNop())
+	slowSub := slow.Subscribe("slow", 8, DropOldest)
+	other := New(zap.NewNop())
+	otherSub := other.Subscribe("other", 8, DropOldest)
+
+	slow.Writer(Stdout).Write([]byte("line 1\nline 2\nline 3\n"))
+	other.Writer(Stdout).Write([]byte("line 1\n"))
+
+	if dropped := slow.DroppedBytes(); dropped != 14 {
+		t.Errorf("expected 14 dropped bytes, got %d", dropped)
+	}
+	if dropped := other.DroppedBytes(); dropped != 0 {
+		t.Errorf("expected no dropped bytes for another hub, got %d", dropped)
+	}
+	if slowSub.Dropped() != 14 || otherSub.Dropped() != 0 {
+		t.Errorf("expected the subscriptions to count their own dropped bytes, got %d and %d", slowSub.Dropped(), otherSub.Dropped())
+	}
+}
+
+func TestUnsubscribeStopsDelivery(t *testing.T) {
+	h := New(zap.NewNop())
+	sub := h.Subscribe("test", 0, DropOldest)
+	w := h.Writer(Stdout)
+
+	w.Write([]byte("before\n"))
+	sub.Unsubscribe()
+	w.Write([]byte("after\n"))
+
+	if chunk, ok := sub.Pop(); !ok || string(chunk.Data) != "before\n" {
+		t.Errorf("expected the output queued before unsubscribing, got %q", chunk.Data)
+	}
+	if chunk, ok := sub.Pop(); ok {
+		t.Errorf("expected no output after unsubscribing, got %q", chunk.Data)
+	}
+}
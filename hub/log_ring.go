@@ -0,0 +1,68 @@
+package hub
+
+import (
+	"container/ring"
+	"sync"
+)
+
+// LogRing keeps the most recent lines of output. A size of zero keeps none.
+type LogRing struct {
+	r  *ring.Ring
+	mu sync.RWMutex
+}
+
+func NewLogRing(size int) *LogRing {
+	return &LogRing{
+		r: ring.New(size),
+	}
+}
+
+func (lr *LogRing) Add(s string) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	if lr.r == nil {
+		return
+	}
+	lr.r = lr.r.Next()
+	lr.r.Value = s
+}
+
+// Resize changes the number of lines kept, keeping the most recent ones
+func (lr *LogRing) Resize(size int) {
+	size = max(size, 0)
+	lines := lr.Lines()
+
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	if lr.r.Len() == size {
+		return
+	}
+	lr.r = ring.New(size)
+	for _, line := range lines[max(0, len(lines)-size):] {
+		lr.r = lr.r.Next()
+		lr.r.Value = line
+	}
+}
+
+// Lines returns the kept lines, oldest first
+func (lr *LogRing) Lines() []string {
+	lr.mu.RLock()
+	defer lr.mu.RUnlock()
+
+	var result []string
+	if lr.r == nil {
+		return result
+	}
+
+	startNode := lr.r.Next()
+
+	startNode.Do(func(v any) {
+		if v != nil {
+			result = append(result, v.(string))
+		}
+	})
+
+	return result
+}
@@ -0,0 +1,160 @@
+package hub
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// OverflowPolicy decides what happens once a subscriber's queue is full
+type OverflowPolicy string
+
+const (
+	// DropOldest discards the oldest queued output to make room for new output
+	DropOldest OverflowPolicy = "drop-oldest"
+	// Disconnect closes the queue, and with it the subscriber, once it is full
+	Disconnect OverflowPolicy = "disconnect"
+)
+
+func ParseOverflowPolicy(s string) (OverflowPolicy, error) {
+	switch OverflowPolicy(s) {
+	case DropOldest, Disconnect:
+		return OverflowPolicy(s), nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy '%s', expected %s or %s", s, DropOldest, Disconnect)
+	}
+}
+
+// Chunk is a line of server output, or the longest run of output allowed in one line
+type Chunk struct {
+	Target Target
+	Data   []byte
+	// Seq numbers each line published by a Hub across both streams
+	Seq  uint64
+	Time time.Time
+}
+
+// Queue is a bounded buffer between the server's output and one subscriber, such as
+// an SSH client. Push never blocks, so a stalled subscriber can never stall the server. When the
+// queue would exceed maxBytes, the overflow policy decides whether the oldest output is dropped
+// or the queue is closed.
+type Queue struct {
+	maxBytes int
+	policy   OverflowPolicy
+
+	mu      sync.Mutex
+	chunks  []Chunk
+	size    int
+	closed  bool
+	dropped uint64
+	// totalDropped, when set, also counts the dropped bytes, such as for all subscriptions of a Hub
+	totalDropped *atomic.Uint64
+	// overflowed is set once the queue has been closed by the disconnect policy
+	overflowed bool
+	ready      chan struct{}
+}
+
+func NewQueue(maxBytes int, policy OverflowPolicy) *Queue {
+	return &Queue{
+		maxBytes: maxBytes,
+		policy:   policy,
+		ready:    make(chan struct{}, 1),
+	}
+}
+
+func (q *Queue) notify() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Push queues a copy of the given output. It returns false if the queue is closed,
+// which includes when this push overflowed a queue using the disconnect policy.
+func (q *Queue) Push(chunk Chunk) bool {
+	p := chunk.Data
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return false
+	}
+
+	if q.maxBytes > 0 && q.size+len(p) > q.maxBytes {
+		if q.policy == Disconnect {
+			q.overflowed = true
+			q.closed = true
+			q.notify()
+			return false
+		}
+
+		for len(q.chunks) > 0 && q.size+len(p) > q.maxBytes {
+			oldest := q.chunks[0]
+			q.chunks[0] = Chunk{}
+			q.chunks = q.chunks[1:]
+			q.size -= len(oldest.Data)
+			q.dropped += uint64(len(oldest.Data))
+			if q.totalDropped != nil {
+				q.totalDropped.Add(uint64(len(oldest.Data)))
+			}
+		}
+	}
+
+	chunk.Data = bytes.Clone(p)
+	q.chunks = append(q.chunks, chunk)
+	q.size += len(p)
+	q.notify()
+	return true
+}
+
+// Pop waits for the next queued chunk. It returns false once the queue is closed and,
+// unless the queue overflowed, fully drained.
+func (q *Queue) Pop() (Chunk, bool) {
+	for {
+		q.mu.Lock()
+		if q.overflowed {
+			q.mu.Unlock()
+			return Chunk{}, false
+		}
+		if len(q.chunks) > 0 {
+			chunk := q.chunks[0]
+			q.chunks[0] = Chunk{}
+			q.chunks = q.chunks[1:]
+			q.size -= len(chunk.Data)
+			q.mu.Unlock()
+			return chunk, true
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return Chunk{}, false
+		}
+		q.mu.Unlock()
+
+		<-q.ready
+	}
+}
+
+// Close ends the queue. Output already queued can still be popped.
+func (q *Queue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	q.notify()
+}
+
+// Overflowed reports if the queue was closed because the subscriber fell too far behind
+func (q *Queue) Overflowed() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.overflowed
+}
+
+// Dropped is the number of bytes this queue has discarded
+func (q *Queue) Dropped() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dropped
+}
@@ -0,0 +1,123 @@
+package hub
+
+import (
+	"testing"
+	"time"
+)
+
+func chunkOf(s string) Chunk {
+	return Chunk{Data: []byte(s)}
+}
+
+// popAll drains a closed queue
+func popAll(q *Queue) []string {
+	var popped []string
+	for {
+		chunk, ok := q.Pop()
+		if !ok {
+			return popped
+		}
+		popped = append(popped, string(chunk.Data))
+	}
+}
+
+func TestQueueOverflow(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int
+		policy   OverflowPolicy
+		pushes   []string
+		// rejected is the index of the first push expected to fail, or -1
+		rejected   int
+		popped     []string
+		dropped    uint64
+		overflowed bool
+	}{
+		{"within the limit", 8, DropOldest, []string{"ab", "cd", "ef"}, -1, []string{"ab", "cd", "ef"}, 0, false},
+		{"drops oldest", 6, DropOldest, []string{"ab", "cd", "ef", "ghij"}, -1, []string{"ef", "ghij"}, 4, false},
+		{"drops everything for a chunk over the limit", 4, DropOldest, []string{"ab", "cd", "efghij"}, -1, []string{"efghij"}, 4, false},
+		{"unbounded", 0, Disconnect, []string{"ab", "cd", "ef"}, -1, []string{"ab", "cd", "ef"}, 0, false},
+		{"disconnects", 4, Disconnect, []string{"ab", "cd", "ef", "gh"}, 2, nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := NewQueue(tt.maxBytes, tt.policy)
+			for i, p := range tt.pushes {
+				expected := tt.rejected < 0 || i < tt.rejected
+				if ok := q.Push(chunkOf(p)); ok != expected {
+					t.Errorf("push %d: expected %t, got %t", i, expected, ok)
+				}
+			}
+			q.Close()
+
+			popped := popAll(q)
+			if len(popped) != len(tt.popped) {
+				t.Fatalf("expected %q, got %q", tt.popped, popped)
+			}
+			for i := range popped {
+				if popped[i] != tt.popped[i] {
+					t.Errorf("expected %q, got %q", tt.popped, popped)
+				}
+			}
+			if dropped := q.Dropped(); dropped != tt.dropped {
+				t.Errorf("expected %d dropped bytes, got %d", tt.dropped, dropped)
+			}
+			if overflowed := q.Overflowed(); overflowed != tt.overflowed {
+				t.Errorf("expected overflowed=%t, got %t", tt.overflowed, overflowed)
+			}
+		})
+	}
+}
+
+func TestQueuePushCopiesData(t *testing.T) {
+	q := NewQueue(0, DropOldest)
+	data := []byte("line")
+	q.Push(Chunk{Data: data})
+	copy(data, "LINE")
+
+	if chunk, _ := q.Pop(); string(chunk.Data) != "line" {
+		t.Errorf("expected the queued output to be unaffected by reuse of the buffer, got %q", chunk.Data)
+	}
+}
+
+func TestQueuePopWaits(t *testing.T) {
+	q := NewQueue(0, DropOldest)
+	popped := make(chan string)
+	go func() {
+		chunk, _ := q.Pop()
+		popped <- string(chunk.Data)
+	}()
+
+	select {
+	case p := <-popped:
+		t.Fatalf("expected pop to wait for output, got %q", p)
+	case <-time.After(50 * time.Millisecond):
+	}
+	q.Push(chunkOf("line"))
+	select {
+	case p := <-popped:
+		if p != "line" {
+			t.Errorf("expected %q, got %q", "line", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for pop")
+	}
+
+	if q.Close(); q.Push(chunkOf("late")) {
+		t.Error("expected push to a closed queue to fail")
+	}
+	if _, ok := q.Pop(); ok {
+		t.Error("expected pop of a closed, drained queue to fail")
+	}
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	for _, s := range []string{"drop-oldest", "disconnect"} {
+		if policy, err := ParseOverflowPolicy(s); err != nil || string(policy) != s {
+			t.Errorf("ParseOverflowPolicy(%q) = %q, %v", s, policy, err)
+		}
+	}
+	if _, err := ParseOverflowPolicy("block"); err == nil {
+		t.Error("expected an unknown policy to be rejected")
+	}
+}
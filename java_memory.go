@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pbnjay/memory"
+	"go.uber.org/zap"
+)
+
+const (
+	// javaMemoryArgs inserts the heap options right after the java executable in the server's arguments
+	javaMemoryArgs = "args"
+	// javaMemoryToolOptions appends the heap options to JAVA_TOOL_OPTIONS
+	javaMemoryToolOptions = "tool-options"
+)
+
+const (
+	javaToolOptionsEnv = "JAVA_TOOL_OPTIONS"
+	// javaMinHeap is the smallest maximum heap that is still worth setting
+	javaMinHeap = 64 * 1024 * 1024
+)
+
+// javaHeap is the heap computed from the memory available to the server
+type javaHeap struct {
+	limit    uint64
+	source   string
+	headroom uint64
+	max      uint64
+	initial  uint64
+}
+
+func (h *javaHeap) options() []string {
+	return []string{
+		fmt.Sprintf("-Xms%dm", h.initial/1024/1024),
+		fmt.Sprintf("-Xmx%dm", h.max/1024/1024),
+	}
+}
+
+// computeJavaHeap sizes the heap as the container's memory limit less the headroom left for
+// the JVM's off-heap memory, such as metaspace, thread stacks, direct buffers and the JIT
+func computeJavaHeap(headroomSetting string, initialPercent int) (*javaHeap, error) {
+	limit, source := containerMemoryLimit()
+
+	headroom, err := parseMemoryHeadroom(headroomSetting, limit)
+	if err != nil {
+		return nil, err
+	}
+	if headroom >= limit || limit-headroom < javaMinHeap {
+		return nil, fmt.Errorf("headroom of %dMB leaves too little of the %dMB memory limit for the heap",
+			headroom/1024/1024, limit/1024/1024)
+	}
+
+	heap := &javaHeap{
+		limit:    limit,
+		source:   source,
+		headroom: headroom,
+		max:      limit - headroom,
+	}
+	heap.initial = heap.max * uint64(initialPercent) / 100
+	return heap, nil
+}
+
+// applyJavaHeap adds the heap options to the server's arguments or JAVA_TOOL_OPTIONS. Since both
+// come before any heap options given to java, those still take precedence.
+func applyJavaHeap(mode string, heap *javaHeap, executableArgs []string, logger *zap.Logger) ([]string, error) {
+	options := heap.options()
+	logger.Info("Sizing Java heap from the memory limit",
+		zap.Uint64("limitMB", heap.limit/1024/1024),
+		zap.String("limitSource", heap.source),
+		zap.Uint64("headroomMB", heap.headroom/1024/1024),
+		zap.Strings("options", options))
+
+	switch mode {
+	case javaMemoryArgs:
+		if len(executableArgs) == 0 || filepath.Base(executableArgs[0]) != "java" {
+			return nil, fmt.Errorf("the server command must start with java to add heap options to its arguments, use %s instead", javaMemoryToolOptions)
+		}
+		withOptions := append([]string{executableArgs[0]}, options...)
+		return append(withOptions, executableArgs[1:]...), nil
+
+	default:
+		toolOptions := strings.Join(options, " ")
+		if existing := os.Getenv(javaToolOptionsEnv); existing != "" {
+			toolOptions = existing + " " + toolOptions
+		}
+		if err := os.Setenv(javaToolOptionsEnv, toolOptions); err != nil {
+			return nil, err
+		}
+		return executableArgs, nil
+	}
+}
+
+// containerMemoryLimit finds the lowest cgroup v2 or v1 memory limit of the runner's cgroup and
+// its ancestors. Without one, the system's total memory is the limit.
+func containerMemoryLimit() (uint64, string) {
+	total := memory.TotalMemory()
+
+	var limit uint64
+	var source string
+	for _, candidate := range cgroupMemoryFiles("memory.max", "memory.limit_in_bytes") {
+		content, err := os.ReadFile(candidate.file)
+		if err != nil {
+			continue
+		}
+		value := strings.TrimSpace(string(content))
+		if value == "max" {
+			continue
+		}
+		bytes, err := strconv.ParseUint(value, 10, 64)
+		// cgroup v1 reports no limit as a huge number
+		if err != nil || bytes == 0 || (total > 0 && bytes >= total) {
+			continue
+		}
+		if limit == 0 || bytes < limit {
+			limit = bytes
+			source = candidate.version
+		}
+	}
+
+	if limit == 0 {
+		return total, "system memory"
+	}
+	return limit, source
+}
+
+type cgroupMemoryFile struct {
+	file    string
+	version string
+}
+
+// cgroupMemoryFiles lists the given cgroup v2 and v1 memory controller files of the runner's cgroups
+// and their ancestors, starting with the runner's own. Inside a container with its own cgroup namespace,
+// the cgroup is usually the mounted root.
+func cgroupMemoryFiles(v2File string, v1File string) []cgroupMemoryFile {
+	file, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return nil
+	}
+	defer file.Close()
+
+	var files []cgroupMemoryFile
+	addAncestors := func(mount string, cgroupPath string, name string, version string) {
+		for dir := path.Clean("/" + cgroupPath); ; dir = path.Dir(dir) {
+			files = append(files, cgroupMemoryFile{
+				file:    filepath.Join(mount, dir, name),
+				version: version,
+			})
+			if dir == "/" {
+				return
+			}
+		}
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// each line is hierarchy-id:controllers:path
+		parts := strings.SplitN(scanner.Text(), ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		if parts[0] == "0" && parts[1] == "" {
+			addAncestors("/sys/fs/cgroup", parts[2], v2File, "cgroup v2")
+		}
+		for _, controller := range strings.Split(parts[1], ",") {
+			if controller == "memory" {
+				addAncestors("/sys/fs/cgroup/memory", parts[2], v1File, "cgroup v1")
+			}
+		}
+	}
+	return files
+}
+
+// parseMemoryHeadroom parses the headroom as either a percentage of limit, such as 25%,
+// or a size, such as 1536m or 2g
+func parseMemoryHeadroom(value string, limit uint64) (uint64, error) {
+	value = strings.TrimSpace(value)
+	if percentValue, isPercent := strings.CutSuffix(value, "%"); isPercent {
+		percent, err := strconv.ParseUint(strings.TrimSpace(percentValue), 10, 64)
+		if err != nil || percent >= 100 {
+			return 0, fmt.Errorf("invalid headroom percentage '%s'", value)
+		}
+		return limit * percent / 100, nil
+	}
+	return parseMemorySize(value)
+}
+
+// parseMemorySize parses sizes like java does, as bytes or with a k, m or g suffix
+func parseMemorySize(value string) (uint64, error) {
+	multiplier := uint64(1)
+	number := strings.ToLower(value)
+	switch {
+	case strings.HasSuffix(number, "k"):
+		multiplier = 1024
+	case strings.HasSuffix(number, "m"):
+		multiplier = 1024 * 1024
+	case strings.HasSuffix(number, "g"):
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier != 1 {
+		number = number[:len(number)-1]
+	}
+	size, err := strconv.ParseUint(number, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size '%s', expected a percentage or a size such as 1536m or 2g", value)
+	}
+	return size * multiplier, nil
+}
@@ -0,0 +1,230 @@
+// Package loginlimit locks out clients after too many failed logins and limits the console
+// sessions each client may hold.
+package loginlimit
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// globalFailureWindow is the sliding window used to count failed logins across all clients
+const globalFailureWindow = time.Minute
+
+type loginAttempts struct {
+	failures    int
+	lockouts    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// Limiter tracks failed login attempts per client IP and across all clients, applying
+// an exponentially growing lockout once too many attempts fail. It also caps the number of
+// concurrent console sessions each client IP may hold. A single limiter is shared by the
+// SSH and websocket consoles so that attempts against either count towards the same lockout.
+type Limiter struct {
+	logger *zap.Logger
+	now    func() time.Time
+
+	maxFailures       int
+	lockoutDuration   time.Duration
+	maxLockout        time.Duration
+	globalMaxFailures int
+	maxSessionsPerIP  int
+
+	mu                sync.Mutex
+	clients           map[string]*loginAttempts
+	globalFailures    []time.Time
+	globalLockedUntil time.Time
+	sessions          map[string]int
+	lockoutCount      uint64
+}
+
+// Options are the limits of a Limiter, where zero disables a limit
+type Options struct {
+	// MaxFailures is how many consecutive failed logins from a client IP trigger its lockout
+	MaxFailures int
+	// LockoutDuration is the first lockout of a client IP, which doubles with each further lockout
+	LockoutDuration time.Duration
+	// MaxLockout caps the doubling lockout
+	MaxLockout time.Duration
+	// GlobalMaxFailures is how many failed logins per minute, from all clients, lock out everyone
+	GlobalMaxFailures int
+	// MaxSessionsPerIP is how many concurrent console sessions each client IP may hold
+	MaxSessionsPerIP int
+}
+
+func New(opts Options, logger *zap.Logger) *Limiter {
+	maxLockout := opts.MaxLockout
+	if maxLockout < opts.LockoutDuration {
+		maxLockout = opts.LockoutDuration
+	}
+	return &Limiter{
+		logger:            logger,
+		now:               time.Now,
+		maxFailures:       opts.MaxFailures,
+		lockoutDuration:   opts.LockoutDuration,
+		maxLockout:        maxLockout,
+		globalMaxFailures: opts.GlobalMaxFailures,
+		maxSessionsPerIP:  opts.MaxSessionsPerIP,
+		clients:           map[string]*loginAttempts{},
+		sessions:          map[string]int{},
+	}
+}
+
+// RemoteIP strips the port from a remote address so that attempts are tracked per host
+func RemoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// Allow reports whether a login attempt from the given IP may proceed and, if not, how long
+// until the lockout expires.
+func (l *Limiter) Allow(ip string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if now.Before(l.globalLockedUntil) {
+		return false, l.globalLockedUntil.Sub(now)
+	}
+	if attempts, exists := l.clients[ip]; exists && now.Before(attempts.lockedUntil) {
+		return false, attempts.lockedUntil.Sub(now)
+	}
+	return true, 0
+}
+
+// RecordFailure counts a failed login from the given IP and triggers a lockout once the
+// per-IP or global threshold is reached.
+func (l *Limiter) RecordFailure(ip string, transport string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.pruneLocked(now)
+
+	if l.maxFailures > 0 {
+		attempts, exists := l.clients[ip]
+		if !exists {
+			attempts = &loginAttempts{}
+			l.clients[ip] = attempts
+		}
+		attempts.failures++
+		attempts.lastFailure = now
+
+		if attempts.failures >= l.maxFailures {
+			lockout := l.maxLockout
+			if attempts.lockouts < 32 {
+				if backoff := l.lockoutDuration << attempts.lockouts; backoff > 0 && backoff < lockout {
+					lockout = backoff
+				}
+			}
+			attempts.failures = 0
+			attempts.lockouts++
+			attempts.lockedUntil = now.Add(lockout)
+			l.lockoutCount++
+
+			l.logger.Warn("Login lockout triggered for client",
+				zap.String("ip", ip),
+				zap.String("transport", transport),
+				zap.Duration("lockout", lockout),
+				zap.Int("consecutiveLockouts", attempts.lockouts),
+				zap.Uint64("totalLockouts", l.lockoutCount),
+			)
+		}
+	}
+
+	if l.globalMaxFailures > 0 {
+		l.globalFailures = append(l.globalFailures, now)
+		if len(l.globalFailures) >= l.globalMaxFailures && !now.Before(l.globalLockedUntil) {
+			l.globalLockedUntil = now.Add(l.lockoutDuration)
+			l.globalFailures = l.globalFailures[:0]
+			l.lockoutCount++
+
+			l.logger.Warn("Global login lockout triggered, too many failed logins from all clients",
+				zap.String("transport", transport),
+				zap.Int("failuresPerMinute", l.globalMaxFailures),
+				zap.Duration("lockout", l.lockoutDuration),
+				zap.Uint64("totalLockouts", l.lockoutCount),
+			)
+		}
+	}
+}
+
+// RecordSuccess clears the failure history of the given IP
+func (l *Limiter) RecordSuccess(ip string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	delete(l.clients, ip)
+	l.mu.Unlock()
+}
+
+// AcquireSession reserves one of the concurrent sessions allowed for the given IP.
+// Each successful call must be paired with ReleaseSession.
+func (l *Limiter) AcquireSession(ip string) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxSessionsPerIP > 0 && l.sessions[ip] >= l.maxSessionsPerIP {
+		l.logger.Warn("Console session rejected, too many concurrent sessions from client",
+			zap.String("ip", ip),
+			zap.Int("maxSessions", l.maxSessionsPerIP),
+		)
+		return false
+	}
+	l.sessions[ip]++
+	return true
+}
+
+// ReleaseSession frees a session reserved by AcquireSession
+func (l *Limiter) ReleaseSession(ip string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.sessions[ip] <= 1 {
+		delete(l.sessions, ip)
+	} else {
+		l.sessions[ip]--
+	}
+}
+
+// pruneLocked drops stale state so that the tracking maps can't grow without bound
+// during a long-running spray. Must be called with mu held.
+func (l *Limiter) pruneLocked(now time.Time) {
+	windowStart := now.Add(-globalFailureWindow)
+	keep := 0
+	for keep < len(l.globalFailures) && l.globalFailures[keep].Before(windowStart) {
+		keep++
+	}
+	l.globalFailures = l.globalFailures[keep:]
+
+	for ip, attempts := range l.clients {
+		if now.After(attempts.lockedUntil) && now.Sub(attempts.lastFailure) > l.maxLockout {
+			delete(l.clients, ip)
+		}
+	}
+}
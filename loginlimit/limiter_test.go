@@ -0,0 +1,154 @@
+package loginlimit
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// testLimiter returns a limiter whose clock only moves when the returned function advances it
+func testLimiter(opts Options) (*Limiter, func(time.Duration)) {
+	limiter := New(opts, zap.NewNop())
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+	return limiter, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestLockoutGrowth(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxLockout time.Duration
+		// lockouts are the expected durations of each consecutive lockout
+		lockouts []time.Duration
+	}{
+		{"doubles", time.Hour, []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 8 * time.Minute}},
+		{"capped", 3 * time.Minute, []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute}},
+		{"cap below first lockout", 0, []time.Duration{time.Minute, time.Minute}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter, advance := testLimiter(Options{
+				MaxFailures:     3,
+				LockoutDuration: time.Minute,
+				MaxLockout:      tt.maxLockout,
+			})
+			for i, expected := range tt.lockouts {
+				for range 3 {
+					if allowed, _ := limiter.Allow("10.0.0.1"); !allowed {
+						t.Fatalf("lockout %d: locked out before reaching the failure limit", i)
+					}
+					limiter.RecordFailure("10.0.0.1", "test")
+				}
+				allowed, retryAfter := limiter.Allow("10.0.0.1")
+				if allowed || retryAfter != expected {
+					t.Fatalf("lockout %d: expected locked out for %s, got allowed=%t for %s", i, expected, allowed, retryAfter)
+				}
+				advance(retryAfter)
+			}
+		})
+	}
+}
+
+func TestLockoutExpiry(t *testing.T) {
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		allowed bool
+	}{
+		{"just locked", 0, false},
+		{"almost expired", time.Minute - time.Second, false},
+		{"expired", time.Minute, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter, advance := testLimiter(Options{MaxFailures: 2, LockoutDuration: time.Minute, MaxLockout: time.Hour})
+			limiter.RecordFailure("10.0.0.1", "test")
+			limiter.RecordFailure("10.0.0.1", "test")
+			advance(tt.elapsed)
+			if allowed, _ := limiter.Allow("10.0.0.1"); allowed != tt.allowed {
+				t.Errorf("expected allowed=%t, got %t", tt.allowed, allowed)
+			}
+			if allowed, _ := limiter.Allow("10.0.0.2"); !allowed {
+				t.Error("expected another client to be allowed")
+			}
+		})
+	}
+}
+
+func TestSuccessResetsFailures(t *testing.T) {
+	limiter, _ := testLimiter(Options{MaxFailures: 2, LockoutDuration: time.Minute})
+	limiter.RecordFailure("10.0.0.1", "test")
+	limiter.RecordSuccess("10.0.0.1")
+	limiter.RecordFailure("10.0.0.1", "test")
+	if allowed, _ := limiter.Allow("10.0.0.1"); !allowed {
+		t.Error("expected the failure before the successful login to be forgotten")
+	}
+}
+
+func TestGlobalLockout(t *testing.T) {
+	tests := []struct {
+		name string
+		// spacing is the time between failures, each from a different client
+		spacing time.Duration
+		locked  bool
+	}{
+		{"within the window", 10 * time.Second, true},
+		{"spread beyond the window", 30 * time.Second, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limiter, advance := testLimiter(Options{GlobalMaxFailures: 5, LockoutDuration: time.Minute})
+			for i := range 5 {
+				if i > 0 {
+					advance(tt.spacing)
+				}
+				limiter.RecordFailure(fmt.Sprintf("10.0.0.%d", i), "test")
+			}
+			allowed, retryAfter := limiter.Allow("192.168.0.1")
+			if allowed == tt.locked {
+				t.Fatalf("expected locked=%t for a new client", tt.locked)
+			}
+			if tt.locked {
+				if retryAfter != time.Minute {
+					t.Errorf("expected to retry after %s, got %s", time.Minute, retryAfter)
+				}
+				advance(retryAfter)
+				if allowed, _ := limiter.Allow("192.168.0.1"); !allowed {
+					t.Error("expected the global lockout to expire")
+				}
+			}
+		})
+	}
+}
+
+func TestSessionCap(t *testing.T) {
+	limiter, _ := testLimiter(Options{MaxSessionsPerIP: 2})
+	for i := range 2 {
+		if !limiter.AcquireSession("10.0.0.1") {
+			t.Fatalf("session %d: expected to be allowed", i)
+		}
+	}
+	if limiter.AcquireSession("10.0.0.1") {
+		t.Error("expected the session over the cap to be rejected")
+	}
+	if !limiter.AcquireSession("10.0.0.2") {
+		t.Error("expected another client to get a session")
+	}
+	limiter.ReleaseSession("10.0.0.1")
+	if !limiter.AcquireSession("10.0.0.1") {
+		t.Error("expected a released session to be available again")
+	}
+}
+
+func TestNilLimiterAllowsEverything(t *testing.T) {
+	var limiter *Limiter
+	limiter.RecordFailure("10.0.0.1", "test")
+	if allowed, _ := limiter.Allow("10.0.0.1"); !allowed {
+		t.Error("expected a nil limiter to allow logins")
+	}
+	if !limiter.AcquireSession("10.0.0.1") {
+		t.Error("expected a nil limiter to allow sessions")
+	}
+}
@@ -1,60 +1,130 @@
 package main
 
 import (
+	"bufio"
 	"context"
-	"errors"
 	"flag"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"os/exec"
-	"os/signal"
 	"strings"
-	"sync"
-	"syscall"
 	"time"
 
 	"github.com/itzg/go-flagsfiller"
+	"github.com/itzg/mc-server-runner/rcon"
+	"github.com/itzg/mc-server-runner/sshconsole"
+	"github.com/itzg/mc-server-runner/supervisor"
 	"github.com/itzg/zapconfigs"
 	"go.uber.org/zap"
 )
 
 type Args struct {
+	Config                         string        `default:"" usage:"Optional YAML or TOML file with settings named like these flags, which environment variables and flags override" env:"CONFIG_FILE" config:"-"`
+	PrintConfig                    bool          `usage:"Print the effective configuration as YAML, with secrets redacted, and exit" config:"-"`
 	Debug                          bool          `usage:"Enable debug logging"`
-	Bootstrap                      string        `usage:"Specifies a file with commands to initially send to the server"`
-	StopCommand                    string        `default:"stop" usage:"Which command to send to the server to stop it"`
-	StopDuration                   time.Duration `usage:"Amount of time in Golang duration to wait after sending the 'stop' command."`
-	StopServerAnnounceDelay        time.Duration `default:"0s" usage:"Amount of time in Golang duration to wait after announcing server shutdown"`
-	StopServerDelayCommand         string        `use:"Specifies the command to run before StopServerAnnounceDelay runs out. If unset, announces seconds till shutdown" default:""`
+	Bootstrap                      string        `usage:"Specifies a file with commands to initially send to the server, which is a template with directives when its name ends with .tmpl"`
+	StopCommand                    string        `default:"stop" usage:"Which command to send to the server to stop it" reload:"true"`
+	StopDuration                   time.Duration `usage:"Amount of time in Golang duration to wait after sending the 'stop' command." reload:"true"`
+	StopEscalation                 string        `default:"" usage:"Comma-separated signals to send, each followed by how long to wait, when the server hasn't stopped within stop-duration. Such as SIGTERM:30s,SIGQUIT:10s. The process is killed after the last stage" env:"STOP_ESCALATION" reload:"true"`
+	ThreadDumpDir                  string        `default:"" usage:"Directory where a JVM thread dump is saved before a hung server is killed, defaults to the working directory" env:"THREAD_DUMP_DIR"`
+	DisableThreadDump              bool          `usage:"Don't capture a JVM thread dump before killing a hung server" env:"DISABLE_THREAD_DUMP"`
+	DisableReaper                  bool          `usage:"Don't adopt and reap processes orphaned by the server, for when an init such as tini runs the runner" env:"DISABLE_REAPER"`
+	JavaMemory                     string        `default:"" usage:"Size the Java heap from the container memory limit, by adding -Xms and -Xmx to the server's arguments after java (args) or to JAVA_TOOL_OPTIONS (tool-options)" env:"JAVA_MEMORY"`
+	JavaMemoryHeadroom             string        `default:"25%" usage:"Memory left out of the Java heap for the JVM's off-heap use, as a percentage of the limit or a size such as 1g" env:"JAVA_MEMORY_HEADROOM"`
+	JavaMemoryInitialPercent       int           `default:"100" usage:"Initial Java heap, -Xms, as a percentage of the maximum heap" env:"JAVA_MEMORY_INITIAL_PERCENT"`
+	ServerUser                     string        `default:"" usage:"User name or uid to run the server as, while the runner keeps its own user" env:"SERVER_USER"`
+	ServerGroup                    string        `default:"" usage:"Group name or gid to run the server as, defaults to the primary group of server-user" env:"SERVER_GROUP"`
+	ServerSupplementaryGroups      []string      `default:"" usage:"Comma-separated supplementary group names or gids of the server, defaults to the groups of server-user" env:"SERVER_SUPPLEMENTARY_GROUPS"`
+	ServerNoNewPrivs               bool          `usage:"Prevent the server from gaining privileges, such as through setuid executables" env:"SERVER_NO_NEW_PRIVS"`
+	ServerUmask                    string        `default:"" usage:"Octal umask to start the server with, such as 0027" env:"SERVER_UMASK"`
+	ServerRlimitNofile             string        `default:"" usage:"Open files limit of the server, as soft[:hard] where either may be unlimited" env:"SERVER_RLIMIT_NOFILE"`
+	ServerRlimitCore               string        `default:"" usage:"Core file size limit of the server, as soft[:hard] where either may be unlimited" env:"SERVER_RLIMIT_CORE"`
+	StopServerAnnounceDelay        time.Duration `default:"0s" usage:"Amount of time in Golang duration to wait after announcing server shutdown" reload:"true"`
+	StopServerDelayCommand         string        `use:"Specifies the command to run before StopServerAnnounceDelay runs out. If unset, announces seconds till shutdown" default:"" reload:"true"`
+	SignalActions                  []string      `default:"" usage:"Comma-separated SIGNAL=ACTION entries that override what is done when the runner receives SIGTERM, SIGINT, SIGHUP, SIGQUIT, SIGUSR1 or SIGUSR2. Actions are stop, stop-now, reload, forward, command:<command>, backup or ignore" env:"SIGNAL_ACTIONS"`
+	BackupCommand                  string        `default:"" usage:"Shell command run by the backup signal action, while the server has saving turned off" env:"BACKUP_COMMAND"`
 	DetachStdin                    bool          `usage:"Don't forward stdin and allow process to be put in background"`
 	RemoteConsole                  bool          `usage:"Allow remote shell connections over SSH to server console"`
+	RemoteConsolePrompt            string        `default:"> " usage:"Prompt shown to remote console sessions with a terminal" env:"REMOTE_CONSOLE_PROMPT"`
+	RemoteConsoleHistoryDir        string        `default:"" usage:"Directory where the command history of each remote console user is saved, defaults to .console-history in the home directory" env:"REMOTE_CONSOLE_HISTORY_DIR"`
+	RemoteConsoleHistorySize       int           `default:"100" usage:"Number of commands to keep in each remote console user's history" env:"REMOTE_CONSOLE_HISTORY_SIZE"`
+	RemoteConsoleBufferSize        int           `default:"1048576" usage:"Maximum bytes of output queued for each remote console session that falls behind" env:"REMOTE_CONSOLE_BUFFER_SIZE"`
+	RemoteConsoleOverflowPolicy    string        `default:"drop-oldest" usage:"What to do when a remote console session's output queue is full: drop-oldest or disconnect" env:"REMOTE_CONSOLE_OVERFLOW_POLICY"`
+	RemoteConsoleSftp              bool          `usage:"Enable the SFTP subsystem on the remote console SSH server" env:"REMOTE_CONSOLE_SFTP"`
+	RemoteConsoleSftpRoot          string        `default:"" usage:"Directory that SFTP access is limited to, defaults to the current working directory" env:"REMOTE_CONSOLE_SFTP_ROOT"`
+	RemoteConsoleExecTimeout       time.Duration `default:"2s" usage:"How long to relay server output for a one-shot SSH command, such as ssh host \"list\"" env:"REMOTE_CONSOLE_EXEC_TIMEOUT"`
+	RemoteConsoleAuthorizedKeys    string        `default:"" usage:"File of SSH public keys, in authorized_keys format, that may log into the remote console in addition to the password" env:"REMOTE_CONSOLE_AUTHORIZED_KEYS" reload:"true"`
+	DisableCrashReport             bool          `usage:"Don't write a crash report when the server exits abnormally" env:"DISABLE_CRASH_REPORT"`
+	CrashReportDir                 string        `default:"" usage:"Directory where crash reports are written, defaults to the working directory next to the world" env:"CRASH_REPORT_DIR"`
+	CrashReportLines               int           `default:"100" usage:"Number of the server's last output lines included in a crash report" env:"CRASH_REPORT_LINES"`
+	CrashReportWebhooks            []string      `default:"" usage:"Comma-separated URLs that each crash report is POSTed to as JSON" env:"CRASH_REPORT_WEBHOOKS" secret:"true"`
 	Shell                          string        `usage:"When set, pass the arguments to this shell"`
 	NamedPipe                      string        `usage:"Optional path to create and read a named pipe for console input"`
 	WebsocketConsole               bool          `usage:"Allow remote shell over websocket" env:"WEBSOCKET_CONSOLE"`
 	WebsocketAddress               string        `default:"0.0.0.0:80" usage:"Bind address for websocket server" env:"WEBSOCKET_ADDRESS"`
 	WebsocketDisableOriginCheck    bool          `default:"false" usage:"Disable checking if origin is trusted" env:"WEBSOCKET_DISABLE_ORIGIN_CHECK"`
-	WebsocketAllowedOrigins        []string      `default:"" usage:"Comma-separated list of trusted origins" env:"WEBSOCKET_ALLOWED_ORIGINS"`
-	WebsocketPassword              string        `default:"" usage:"Password will be the same as RCON_PASSWORD if unset" env:"WEBSOCKET_PASSWORD"`
+	WebsocketAllowedOrigins        []string      `default:"" usage:"Comma-separated list of trusted origins, such as https://example.com, https://*.example.com or http://localhost:*" env:"WEBSOCKET_ALLOWED_ORIGINS" reload:"true"`
+	WebsocketAllowSameHostOrigin   bool          `default:"false" usage:"Trust origins that match the host and port the websocket request was sent to" env:"WEBSOCKET_ALLOW_SAME_HOST_ORIGIN" reload:"true"`
+	WebsocketPassword              string        `default:"" usage:"Password will be the same as RCON_PASSWORD if unset" env:"WEBSOCKET_PASSWORD" secret:"true" reload:"true"`
 	WebsocketDisableAuthentication bool          `default:"false" usage:"Disable websocket authentication" env:"WEBSOCKET_DISABLE_AUTHENTICATION"`
-	WebsocketLogBufferSize         int           `default:"50" usage:"Number of log lines to save and send to connecting clients" env:"WEBSOCKET_LOG_BUFFER_SIZE"`
+	WebsocketLogBufferSize         int           `default:"50" usage:"Number of log lines to save and send to connecting clients" env:"WEBSOCKET_LOG_BUFFER_SIZE" reload:"true"`
+	WebsocketSendQueueSize         int           `default:"1048576" usage:"Maximum bytes of output queued for each websocket client that falls behind" env:"WEBSOCKET_SEND_QUEUE_SIZE"`
+	WebsocketOverflowPolicy        string        `default:"drop-oldest" usage:"What to do when a websocket client's send queue is full: drop-oldest or disconnect" env:"WEBSOCKET_OVERFLOW_POLICY"`
+	WebsocketTlsCert               string        `default:"" usage:"PEM certificate file to serve the websocket console over TLS (wss://), reloaded when changed" env:"WEBSOCKET_TLS_CERT"`
+	WebsocketTlsKey                string        `default:"" usage:"PEM private key file for the websocket TLS certificate" env:"WEBSOCKET_TLS_KEY"`
+	WebsocketTlsClientCa           string        `default:"" usage:"When set, websocket clients must present a certificate signed by a CA in this PEM file" env:"WEBSOCKET_TLS_CLIENT_CA"`
+	LoginMaxFailures               int           `default:"5" usage:"Number of failed remote console logins from one IP before it is locked out, 0 disables" env:"LOGIN_MAX_FAILURES"`
+	LoginLockoutDuration           time.Duration `default:"30s" usage:"Initial lockout after too many failed logins, doubles on each repeated lockout" env:"LOGIN_LOCKOUT_DURATION"`
+	LoginMaxLockoutDuration        time.Duration `default:"1h" usage:"Upper limit of the doubling login lockout" env:"LOGIN_MAX_LOCKOUT_DURATION"`
+	LoginGlobalMaxFailures         int           `default:"0" usage:"Number of failed remote console logins per minute from all IPs before all logins are locked out, 0 disables" env:"LOGIN_GLOBAL_MAX_FAILURES"`
+	LoginMaxSessionsPerIP          int           `default:"5" usage:"Maximum number of concurrent remote console sessions from one IP, 0 is unlimited" env:"LOGIN_MAX_SESSIONS_PER_IP"`
+	ReadyLogPattern                string        `default:"" usage:"When set, console input from every source is queued until the server logs a line matching this regex, such as Done" env:"READY_LOG_PATTERN"`
+	ReadyRcon                      bool          `usage:"Queue console input from every source until the server's RCON port accepts connections" env:"READY_RCON"`
+	ReadyTimeout                   time.Duration `default:"5m" usage:"How long to queue console input while waiting for the server to be ready, 0 waits forever" env:"READY_TIMEOUT"`
+	ReadyTimeoutPolicy             string        `default:"flush" usage:"What to do with the queued console input when the server isn't ready in time: flush or drop" env:"READY_TIMEOUT_POLICY"`
+	WatchdogInterval               time.Duration `default:"0s" usage:"How often the watchdog checks that the server is responsive, 0 disables the watchdog" env:"WATCHDOG_INTERVAL"`
+	WatchdogProbe                  string        `default:"console" usage:"How the watchdog checks the server: console sends the probe command and waits for output matching the probe pattern, rcon sends it with rcon-cli or else connects to the RCON port" env:"WATCHDOG_PROBE"`
+	WatchdogProbeCommand           string        `default:"list" usage:"Command the watchdog sends to check the server" env:"WATCHDOG_PROBE_COMMAND"`
+	WatchdogProbePattern           string        `default:"players online" usage:"Regex of the output expected in response to the watchdog's console probe" env:"WATCHDOG_PROBE_PATTERN"`
+	WatchdogTimeout                time.Duration `default:"10s" usage:"How long the watchdog waits for the server to respond to a probe" env:"WATCHDOG_TIMEOUT"`
+	WatchdogOverloadThreshold      int           `default:"0" usage:"Number of \"Can't keep up\" warnings between two watchdog checks that fails the check, 0 only logs them" env:"WATCHDOG_OVERLOAD_THRESHOLD"`
+	WatchdogDumpAfter              int           `default:"2" usage:"Number of consecutive failed watchdog checks after which a thread dump is captured, 0 disables" env:"WATCHDOG_DUMP_AFTER"`
+	WatchdogRestartAfter           int           `default:"3" usage:"Number of consecutive failed watchdog checks after which the server is stopped so it can be restarted, 0 disables" env:"WATCHDOG_RESTART_AFTER"`
+	WatchdogStopDuration           time.Duration `default:"30s" usage:"How long a server stopped by the watchdog has to stop before escalating, used instead of a longer or unlimited stop-duration since a frozen server won't act on the stop command" env:"WATCHDOG_STOP_DURATION"`
+	WatchdogHealthFile             string        `default:"" usage:"File where the watchdog writes healthy or unhealthy after each check, for use by a container health check" env:"WATCHDOG_HEALTH_FILE"`
 }
 
 func main() {
-	// docker stop sends a SIGTERM, so intercept that and send a 'stop' command to the server
-	termChan := make(chan os.Signal, 1)
-	signal.Notify(termChan, syscall.SIGTERM)
+	execServerIfWrapper()
 
-	// Additionally intercept SIGUSR1 which bypasses StopServerAnnounceDelay (in cases where SIGTERM has **and** hasn't been sent)
-	usr1Chan := make(chan os.Signal, 1)
-	signal.Notify(usr1Chan, syscall.SIGUSR1)
+	err := loadEnvFiles()
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	var args Args
-	err := flagsfiller.Parse(&args)
+	err = flagsfiller.Parse(&args)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if args.Config != "" {
+		err = applyConfigFile(&args, flag.CommandLine, args.Config)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if args.PrintConfig {
+		content, err := printConfig(&args)
+		if err != nil {
+			log.Fatal(err)
+		}
+		os.Stdout.Write(content)
+		os.Exit(0)
+	}
+
 	var logger *zap.Logger
 	if args.Debug {
 		logger = zapconfigs.NewDebugLogger()
@@ -65,290 +135,100 @@ func main() {
 	defer logger.Sync()
 	logger = logger.Named("mc-server-runner")
 
-	var cmd *exec.Cmd
-
-	if flag.NArg() < 1 {
-		logger.Fatal("Missing executable arguments")
-	}
-
-	if args.Shell != "" {
-		cmd = exec.Command(args.Shell, flag.Args()...)
-	} else {
-		cmd = exec.Command(flag.Arg(0), flag.Args()[1:]...)
-	}
-
-	stdin, err := cmd.StdinPipe()
+	config, err := newLiveConfig(&args, logger.Named("config"))
 	if err != nil {
-		logger.Error("Unable to get stdin", zap.Error(err))
+		logger.Fatal("Invalid configuration", zap.Error(err))
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	errorChan := make(chan error, 1)
-	var backgroundFinished sync.WaitGroup
-
-	type writers []io.Writer
-	var stdoutWritersList writers
-	var stderrWritersList writers
-	stdoutWritersList = append(stdoutWritersList, os.Stdout)
-	stderrWritersList = append(stderrWritersList, os.Stderr)
-
-	if args.WebsocketConsole {
-		wsOutWriter := &wsWriter{
-			writerType: "stdout",
-		}
-		wsErrWriter := &wsWriter{
-			writerType: "stderr",
-		}
-
-		stdoutWritersList = append(stdoutWritersList, wsOutWriter)
-		stderrWritersList = append(stderrWritersList, wsErrWriter)
-
-		backgroundFinished.Add(1)
-		go runWebsocketServer(
-			ctx,
-			logger,
-			errorChan,
-			&backgroundFinished,
-			wsOutWriter,
-			wsErrWriter,
-			stdin,
-			args.WebsocketDisableAuthentication,
-			args.WebsocketAddress,
-			args.WebsocketAllowedOrigins,
-			args.WebsocketDisableOriginCheck,
-			args.WebsocketLogBufferSize,
-			args.WebsocketPassword,
-		)
-	}
-
-	if args.RemoteConsole {
-		sshStdoutPipe := newPipeWriter(logger)
-		sshStderrPipe := newPipeWriter(logger)
-
-		stdoutWritersList = append(stdoutWritersList, sshStdoutPipe)
-		stderrWritersList = append(stderrWritersList, sshStderrPipe)
-
-		// Create readers for the console
-		sshStdoutReader := sshStdoutPipe.AddReader()
-		sshStderrReader := sshStderrPipe.AddReader()
-
-		console := makeConsole(stdin, sshStdoutReader, sshStderrReader)
-
-		// Relay stdin between outside and server
-		if !args.DetachStdin {
-			go consoleInRoutine(os.Stdin, console, logger)
-		}
-
-		go consoleOutRoutine(os.Stdout, console, stdOutTarget, logger)
-		go consoleOutRoutine(os.Stderr, console, stdErrTarget, logger)
-
-		go runRemoteShellServer(console, logger)
-
-		logger.Info("Running with remote console support")
+	runner, err := newRunner(config, logger)
+	if err != nil {
+		logger.Fatal("Invalid configuration", zap.Error(err))
 	}
+	signalChan := make(chan os.Signal, 1)
+	notifySignals(signalChan, runner.signalActions)
+	runner.signals = signalChan
 
-	if len(stdoutWritersList) == 1 {
-		logger.Debug("Directly assigning stdout/stderr")
-		cmd.Stdout = stdoutWritersList[0]
-		cmd.Stderr = stderrWritersList[0]
-	} else {
-		logger.Debug("Assigning MultiWriter for for stdout/stderr")
-		cmd.Stdout = io.MultiWriter(stdoutWritersList...)
-		cmd.Stderr = io.MultiWriter(stderrWritersList...)
+	if flag.NArg() < 1 {
+		logger.Fatal("Missing executable arguments")
 	}
 
-	if !args.RemoteConsole {
-		if hasRconCli() && args.NamedPipe == "" && !args.WebsocketConsole {
-			logger.Debug("Directly assigning stdin")
-			cmd.Stdin = os.Stdin
-			stdin = os.Stdin
-		} else {
-			go relayStdin(logger, stdin)
-		}
+	exitCode, err := runner.Run(flag.Args())
+	if err != nil {
+		logger.Fatal("Unable to run server", zap.Error(err))
 	}
+	os.Exit(exitCode)
+}
 
-	err = cmd.Start()
+func relayStdin(logger *zap.Logger, from io.Reader, stdin io.Writer) {
+	_, err := io.Copy(stdin, from)
 	if err != nil {
-		logger.Error("Failed to start", zap.Error(err))
+		logger.Error("Failed to relay standard input", zap.Error(err))
 	}
+}
 
-	if args.Bootstrap != "" {
-		bootstrapContent, err := os.ReadFile(args.Bootstrap)
-		if err != nil {
-			logger.Error("Failed to read bootstrap commands", zap.Error(err))
-		}
-		_, err = stdin.Write(bootstrapContent)
+// consoleInRoutine relays the lines of the given input to the server, alongside the remote console sessions
+func consoleInRoutine(stdIn io.Reader, console *sshconsole.Server, logger *zap.Logger) {
+	scanner := bufio.NewScanner(stdIn)
+	for scanner.Scan() {
+		text := scanner.Text()
+		outBytes := []byte(fmt.Sprintf("%s\n", text))
+		_, err := console.WriteToStdIn(outBytes)
 		if err != nil {
-			logger.Error("Failed to write bootstrap content", zap.Error(err))
-		}
-	}
-
-	if args.NamedPipe != "" {
-		err2 := handleNamedPipe(ctx, args.NamedPipe, stdin, errorChan)
-		if err2 != nil {
-			logger.Fatal("Failed to setup named pipe", zap.Error(err2))
-		}
-	}
-
-	cmdExitChan := make(chan int, 1)
-
-	go func() {
-		waitErr := cmd.Wait()
-		if waitErr != nil {
-			var exitErr *exec.ExitError
-			if errors.As(waitErr, &exitErr) {
-				exitCode := exitErr.ExitCode()
-				logger.Warn("Minecraft server failed. Inspect logs above for errors that indicate cause. DO NOT report this line as an error.",
-					zap.Int("exitCode", exitCode))
-				if exitCode == 137 {
-					logger.Error("Exit code 137 usually indicates the process was killed due to excessive memory use.")
-					logSystemMemory(logger)
-				}
-				cmdExitChan <- exitCode
-			}
-			return
-		} else {
-			cmdExitChan <- 0
-		}
-	}()
-
-	var timer *time.Timer
-
-	for {
-		select {
-		case <-termChan:
-			logger.Debug("SIGTERM caught")
-			logger.Info("gracefully stopping server...")
-			cancel()
-			if args.StopServerAnnounceDelay > 0 {
-				if args.StopServerDelayCommand == "" {
-					announceStop(logger, stdin, args.StopServerAnnounceDelay)
-				} else {
-					runStopDelayCommand(logger, stdin, args.StopServerDelayCommand)
-				}
-
-				logger.Info("Sleeping before server stop", zap.Duration("sleepTime", args.StopServerAnnounceDelay))
-				timer = time.AfterFunc(args.StopServerAnnounceDelay, func() {
-					logger.Info("StopServerAnnounceDelay elapsed, stopping server")
-					terminate(logger, stdin, cmd, args.StopDuration, args.StopCommand)
-				})
-			} else {
-				terminate(logger, stdin, cmd, args.StopDuration, args.StopCommand)
-			}
-
-		case <-usr1Chan:
-			if timer != nil {
-				if timer.Stop() {
-					logger.Info("SIGUSR1 caught, bypassing running StopServerAnnounceDelay")
-					cancel()
-					terminate(logger, stdin, cmd, args.StopDuration, args.StopCommand)
-				} else {
-					logger.Info("SIGUSR1 caught, StopServerAnnounceDelay already elapsed, server is already stopping")
-				}
-			} else {
-				logger.Info("SIGUSR1 caught, gracefully stopping server... (without StopServerAnnounceDelay)")
-				cancel()
-				terminate(logger, stdin, cmd, args.StopDuration, args.StopCommand)
-			}
-
-		case backgroundErr := <-errorChan:
-			logger.Error("Error during background processing", zap.Error(backgroundErr))
-			cancel()
-			terminate(logger, stdin, cmd, args.StopDuration, args.StopCommand)
-
-		case exitCode := <-cmdExitChan:
-			cancel()
-			logger.Debug("Waiting on background processes to finish")
-			backgroundFinished.Wait()
-			logger.Info("Done")
-			os.Exit(exitCode)
+			logger.Error("Failed to write to stdin")
 		}
 	}
-
 }
 
-func relayStdin(logger *zap.Logger, stdin io.WriteCloser) {
-	_, err := io.Copy(stdin, os.Stdin)
-	if err != nil {
-		logger.Error("Failed to relay standard input", zap.Error(err))
-	}
+// rconClient configures RCON from RCON_CONFIG_FILE, RCON_PORT and RCON_PASSWORD as they are
+// currently set, since a configuration reload may change them
+func rconClient() *rcon.Client {
+	return rcon.New(rcon.Options{
+		ConfigFile: os.Getenv("RCON_CONFIG_FILE"),
+		Port:       os.Getenv("RCON_PORT"),
+		Password:   os.Getenv("RCON_PASSWORD"),
+	})
 }
 
-func hasRconCli() bool {
+// rconEnabled reports whether ENABLE_RCON is set and rcon-cli is installed
+func rconEnabled() bool {
 	if strings.ToUpper(os.Getenv("ENABLE_RCON")) == "TRUE" {
-		_, err := exec.LookPath("rcon-cli")
-		return err == nil
+		return rconClient().Available()
 	} else {
 		return false
 	}
 }
 
-func sendRconCommand(cmd ...string) error {
-	rconConfigFile := os.Getenv("RCON_CONFIG_FILE")
-	if rconConfigFile == "" {
-		port := os.Getenv("RCON_PORT")
-		if port == "" {
-			port = "25575"
-		}
-
-		password := os.Getenv("RCON_PASSWORD")
-		if password == "" {
-			password = "minecraft"
-		}
-
-		args := []string{"--port", port,
-			"--password", password}
-		args = append(args, cmd...)
-
-		rconCliCmd := exec.Command("rcon-cli", args...)
-
-		return rconCliCmd.Run()
-	} else {
-
-		args := []string{"--config", rconConfigFile}
-		args = append(args, cmd...)
-
-		rconCliCmd := exec.Command("rcon-cli", args...)
-
-		return rconCliCmd.Run()
-	}
-}
-
 // sendCommand will send the given command via RCON when available, otherwise it will write to the given stdin
 func sendCommand(stdin io.Writer, cmd ...string) error {
-	if hasRconCli() {
-		return sendRconCommand(cmd...)
+	if rconEnabled() {
+		return rconClient().Command(context.Background(), cmd...)
 	} else {
-		_, err := stdin.Write([]byte(strings.Join(cmd, " ")))
+		_, err := stdin.Write([]byte(strings.Join(cmd, " ") + "\n"))
 		return err
 	}
 }
 
-// terminate sends `stop` to the server and kill process once stopDuration elapsed
-func terminate(logger *zap.Logger, stdin io.Writer, cmd *exec.Cmd, stopDuration time.Duration, stopCommand string) {
-	if stopCommand == "" {
-		stopCommand = "stop"
+// stopOptions is how the server is stopped with the given configuration
+func stopOptions(args *Args, logger *zap.Logger) supervisor.StopOptions {
+	stages, err := supervisor.ParseStopEscalation(parseListSetting(args.StopEscalation))
+	if err != nil {
+		logger.Error("Invalid stop escalation, killing once stop duration elapses", zap.Error(err))
 	}
-	if hasRconCli() {
-		err := stopWithRconCli(stopCommand)
-		if err != nil {
-			logger.Error("Failed to stop using rcon-cli", zap.Error(err))
-			stopViaConsole(logger, stdin, stopCommand)
-		}
-	} else {
-		stopViaConsole(logger, stdin, stopCommand)
+	return supervisor.StopOptions{
+		Command:    args.StopCommand,
+		Duration:   args.StopDuration,
+		Escalation: stages,
 	}
+}
 
-	logger.Info("Waiting for completion...")
-	if stopDuration != 0 {
-		time.AfterFunc(stopDuration, func() {
-			logger.Error("Took too long, so killing server process")
-			err := cmd.Process.Kill()
-			if err != nil {
-				logger.Error("Failed to forcefully kill process")
-			}
-		})
+// watchdogStopOptions are the stop options for a server the watchdog found unresponsive, which is
+// unlikely to stop by itself, so the stop escalates after at most the watchdog stop duration
+func watchdogStopOptions(args *Args, logger *zap.Logger) supervisor.StopOptions {
+	opts := stopOptions(args, logger)
+	if opts.Duration == 0 || opts.Duration > args.WatchdogStopDuration {
+		opts.Duration = args.WatchdogStopDuration
 	}
+	return opts
 }
 
 func runStopDelayCommand(logger *zap.Logger, stdin io.Writer, command string) {
@@ -372,13 +252,5 @@ func announceStop(logger *zap.Logger, stdin io.Writer, shutdownDelay time.Durati
 func stopWithRconCli(stopCommand string) error {
 	log.Println("Stopping with rcon-cli")
 
-	return sendRconCommand(stopCommand)
-}
-
-func stopViaConsole(logger *zap.Logger, stdin io.Writer, stopCommand string) {
-	logger.Info("Sending '" + stopCommand + "' to Minecraft server...")
-	_, err := stdin.Write([]byte(stopCommand + "\n"))
-	if err != nil {
-		logger.Error("Failed to write stop command to server console", zap.Error(err))
-	}
+	return rconClient().Command(context.Background(), stopCommand)
 }
@@ -0,0 +1,81 @@
+// Package rcon sends commands to the server's RCON port with rcon-cli.
+package rcon
+
+import (
+	"context"
+	"net"
+	"os/exec"
+)
+
+const (
+	DefaultHost     = "127.0.0.1"
+	DefaultPort     = "25575"
+	DefaultPassword = "minecraft"
+	DefaultCliPath  = "rcon-cli"
+)
+
+// Options configure a Client, where each empty option has its default
+type Options struct {
+	// Host is where the server's RCON port can be reached
+	Host     string
+	Port     string
+	Password string
+	// ConfigFile is an rcon-cli configuration file that is used instead of Port and Password when set
+	ConfigFile string
+	// CliPath is the rcon-cli executable, which is looked up in the PATH unless it contains a slash
+	CliPath string
+}
+
+// Client runs rcon-cli for each command
+type Client struct {
+	opts Options
+}
+
+func New(opts Options) *Client {
+	if opts.Host == "" {
+		opts.Host = DefaultHost
+	}
+	if opts.Port == "" {
+		opts.Port = DefaultPort
+	}
+	if opts.Password == "" {
+		opts.Password = DefaultPassword
+	}
+	if opts.CliPath == "" {
+		opts.CliPath = DefaultCliPath
+	}
+	return &Client{opts: opts}
+}
+
+// Available reports whether rcon-cli is installed
+func (c *Client) Available() bool {
+	_, err := exec.LookPath(c.opts.CliPath)
+	return err == nil
+}
+
+// Command sends the command, given as words, with the rcon-cli process bound to ctx
+func (c *Client) Command(ctx context.Context, command ...string) error {
+	var args []string
+	if c.opts.ConfigFile != "" {
+		args = []string{"--config", c.opts.ConfigFile}
+	} else {
+		args = []string{"--host", c.opts.Host,
+			"--port", c.opts.Port,
+			"--password", c.opts.Password}
+	}
+	args = append(args, command...)
+
+	rconCliCmd := exec.CommandContext(ctx, c.opts.CliPath, args...)
+
+	return rconCliCmd.Run()
+}
+
+// Address is where the server's RCON port can be reached
+func (c *Client) Address() string {
+	return net.JoinHostPort(c.opts.Host, c.opts.Port)
+}
+
+// Password is the RCON password, which the consoles also accept by default
+func (c *Client) Password() string {
+	return c.opts.Password
+}
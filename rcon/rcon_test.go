@@ -0,0 +1,88 @@
+package rcon
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeCli writes an rcon-cli stand-in that records its arguments, one per line
+func fakeCli(t *testing.T) (cliPath string, argsFile string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake rcon-cli is a shell script")
+	}
+	dir := t.TempDir()
+	cliPath = filepath.Join(dir, "rcon-cli")
+	argsFile = filepath.Join(dir, "args")
+	script := "#!/bin/sh\nprintf '%s\\n' \"$@\" > " + argsFile + "\n"
+	if err := os.WriteFile(cliPath, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return cliPath, argsFile
+}
+
+func TestNewDefaults(t *testing.T) {
+	client := New(Options{})
+	if address := client.Address(); address != "127.0.0.1:25575" {
+		t.Errorf("expected the default address, got %s", address)
+	}
+	if password := client.Password(); password != DefaultPassword {
+		t.Errorf("expected the default password, got %s", password)
+	}
+
+	client = New(Options{Host: "::1", Port: "25576", Password: "secret"})
+	if address := client.Address(); address != "[::1]:25576" {
+		t.Errorf("expected the configured address, got %s", address)
+	}
+	if password := client.Password(); password != "secret" {
+		t.Errorf("expected the configured password, got %s", password)
+	}
+}
+
+func TestCommand(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Options
+		expected []string
+	}{
+		{"address", Options{Host: "mc", Port: "25576", Password: "secret"},
+			[]string{"--host", "mc", "--port", "25576", "--password", "secret", "say", "hello world"}},
+		{"config file", Options{Password: "ignored", ConfigFile: "/data/.rcon-cli.env"},
+			[]string{"--config", "/data/.rcon-cli.env", "say", "hello world"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cliPath, argsFile := fakeCli(t)
+			tt.opts.CliPath = cliPath
+			client := New(tt.opts)
+			if !client.Available() {
+				t.Fatal("expected the rcon-cli to be available")
+			}
+
+			if err := client.Command(context.Background(), "say", "hello world"); err != nil {
+				t.Fatal(err)
+			}
+			args, err := os.ReadFile(argsFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Split(strings.TrimSuffix(string(args), "\n"), "\n"); strings.Join(got, "|") != strings.Join(tt.expected, "|") {
+				t.Errorf("expected args %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	client := New(Options{CliPath: filepath.Join(t.TempDir(), "rcon-cli")})
+	if client.Available() {
+		t.Error("expected a missing rcon-cli to be unavailable")
+	}
+	if err := client.Command(context.Background(), "stop"); err == nil {
+		t.Error("expected a command to fail without rcon-cli")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/itzg/mc-server-runner/hub"
+	"github.com/itzg/mc-server-runner/supervisor"
+	"go.uber.org/zap"
+)
+
+const (
+	// readyTimeoutFlush sends the queued input anyway when the server isn't ready in time
+	readyTimeoutFlush = "flush"
+	// readyTimeoutDrop discards the queued input when the server isn't ready in time
+	readyTimeoutDrop = "drop"
+)
+
+// readyGateMaxQueue bounds the input held back while waiting for the server to be ready
+const readyGateMaxQueue = 1024 * 1024
+
+// readyRconInterval is how often the RCON port is checked while waiting for the server
+const readyRconInterval = 2 * time.Second
+
+// readyGate sits in front of the server's stdin and holds back all input, from every source,
+// until the server is ready for commands. The held input is then written in the order received.
+type readyGate struct {
+	out    io.WriteCloser
+	logger *zap.Logger
+
+	// opened is closed once the gate opens
+	opened chan struct{}
+
+	mu     sync.Mutex
+	open   bool
+	queued []byte
+	// overflowed is set once input had to be discarded because the queue was full
+	overflowed bool
+}
+
+func newReadyGate(out io.WriteCloser, logger *zap.Logger) *readyGate {
+	return &readyGate{
+		out:    out,
+		logger: logger,
+		opened: make(chan struct{}),
+	}
+}
+
+func (g *readyGate) Write(p []byte) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.open {
+		return g.out.Write(p)
+	}
+
+	if len(g.queued)+len(p) > readyGateMaxQueue {
+		if !g.overflowed {
+			g.logger.Warn("Too much input queued while waiting for the server to be ready, discarding more")
+			g.overflowed = true
+		}
+		return len(p), nil
+	}
+	g.queued = append(g.queued, p...)
+	return len(p), nil
+}
+
+// Opened is closed once the gate has opened, whether or not the server became ready
+func (g *readyGate) Opened() <-chan struct{} {
+	return g.opened
+}
+
+func (g *readyGate) Close() error {
+	return g.out.Close()
+}
+
+// Open writes the queued input and lets further input through. When flush is false,
+// the queued input is discarded instead.
+func (g *readyGate) Open(reason string, flush bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.open {
+		return
+	}
+	g.open = true
+	close(g.opened)
+
+	if !flush {
+		if len(g.queued) > 0 {
+			g.logger.Warn("Discarding input queued while waiting for the server to be ready",
+				zap.String("reason", reason), zap.Int("bytes", len(g.queued)))
+		}
+		g.queued = nil
+		return
+	}
+
+	g.logger.Info("Sending input queued while waiting for the server to be ready",
+		zap.String("reason", reason), zap.Int("bytes", len(g.queued)))
+	if _, err := g.out.Write(g.queued); err != nil {
+		g.logger.Error("Failed to write queued input", zap.Error(err))
+	}
+	g.queued = nil
+}
+
+// watchReady opens the gate when the server logs a line matching pattern or, if useRcon is set,
+// when the RCON port accepts connections. If neither happens within timeout, the gate is opened
+// according to timeoutPolicy. The gate is also opened once ctx is done, which is when the server is stopping.
+func watchReady(ctx context.Context, gate *readyGate, output *hub.Subscription, pattern *regexp.Regexp,
+	useRcon bool, timeout time.Duration, timeoutPolicy string, lifecycle *supervisor.Lifecycle, logger *zap.Logger) {
+
+	ready := make(chan string, 2)
+
+	if output != nil {
+		// also stops the goroutine below when the gate opens for another reason
+		defer output.Unsubscribe()
+		go func() {
+			for {
+				chunk, ok := output.Pop()
+				if !ok {
+					return
+				}
+				if pattern.Match(chunk.Data) {
+					ready <- "server logged a line matching " + pattern.String()
+					return
+				}
+			}
+		}()
+	}
+
+	if useRcon {
+		go func() {
+			address := rconClient().Address()
+			ticker := time.NewTicker(readyRconInterval)
+			defer ticker.Stop()
+			for {
+				conn, err := net.DialTimeout("tcp", address, time.Second)
+				if err == nil {
+					conn.Close()
+					ready <- fmt.Sprintf("RCON is accepting connections on %s", address)
+					return
+				}
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutChan = timer.C
+	}
+
+	select {
+	case reason := <-ready:
+		logger.Info("Server is ready for commands", zap.String("reason", reason))
+		gate.Open(reason, true)
+		lifecycle.Set(supervisor.Ready, reason)
+	case <-timeoutChan:
+		logger.Warn("Timed out waiting for the server to be ready for commands",
+			zap.Duration("timeout", timeout), zap.String("policy", timeoutPolicy))
+		gate.Open("timed out", timeoutPolicy != readyTimeoutDrop)
+	case <-ctx.Done():
+		// The stop command must reach the server, even if it never became ready
+		gate.Open("server stopping", true)
+	}
+}
+
+// watchServerDone sets the state to ready once the server logs that it's done starting
+func watchServerDone(ctx context.Context, output *hub.Subscription, lifecycle *supervisor.Lifecycle) {
+	defer output.Unsubscribe()
+	go func() {
+		<-ctx.Done()
+		output.Unsubscribe()
+	}()
+
+	for {
+		chunk, ok := output.Pop()
+		if !ok {
+			return
+		}
+		if serverDonePattern.Match(chunk.Data) {
+			lifecycle.Set(supervisor.Ready, "server logged that it's done starting")
+			return
+		}
+	}
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/itzg/mc-server-runner/hub"
+	"github.com/itzg/mc-server-runner/loginlimit"
+	"github.com/itzg/mc-server-runner/sshconsole"
+	"github.com/itzg/mc-server-runner/supervisor"
+	"github.com/itzg/mc-server-runner/wsconsole"
+	"go.uber.org/zap"
+	"golang.org/x/term"
+)
+
+// Runner runs the server process along with the consoles and watchers around it, and stops
+// the server when signalled
+type Runner struct {
+	config        *liveConfig
+	logger        *zap.Logger
+	lifecycle     *supervisor.Lifecycle
+	signalActions map[syscall.Signal]signalAction
+	privileges    *serverPrivileges
+
+	clock supervisor.Clock
+	// start starts the server process, which has been set up but not started
+	start func(cmd *exec.Cmd) error
+	// signals are dispatched according to signalActions
+	signals <-chan os.Signal
+
+	// stdin is relayed to the server, unless nil
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// newRunner sets up a runner that starts the server with the configured user and limits,
+// and uses the runner's own standard streams. It receives no signals until signals is set.
+func newRunner(config *liveConfig, logger *zap.Logger) (*Runner, error) {
+	args := config.Get().args
+
+	privileges, err := parseServerPrivileges(args)
+	if err != nil {
+		return nil, fmt.Errorf("invalid server user or limits: %w", err)
+	}
+
+	signalActions, err := parseSignalActions(args.SignalActions)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signal actions: %w", err)
+	}
+
+	return &Runner{
+		config:        config,
+		logger:        logger,
+		lifecycle:     supervisor.NewLifecycle(logger.Named("lifecycle")),
+		signalActions: signalActions,
+		privileges:    privileges,
+		clock:         supervisor.RealClock{},
+		start: func(cmd *exec.Cmd) error {
+			supervisor.SetProcessGroup(cmd)
+			return startServer(cmd, privileges)
+		},
+		stdin:  os.Stdin,
+		stdout: os.Stdout,
+		stderr: os.Stderr,
+	}, nil
+}
+
+// Run starts the server with executableArgs and returns its exit code once it exits.
+// An error is returned when the server or its surroundings couldn't be set up.
+func (r *Runner) Run(executableArgs []string) (int, error) {
+	args := r.config.Get().args
+	logger := r.logger
+	serverLifecycle := r.lifecycle
+
+	if len(executableArgs) < 1 {
+		return 1, errors.New("missing executable arguments")
+	}
+
+	if args.JavaMemory != "" {
+		heap, err := computeJavaHeap(args.JavaMemoryHeadroom, args.JavaMemoryInitialPercent)
+		if err != nil {
+			return 1, fmt.Errorf("unable to size the Java heap: %w", err)
+		}
+		executableArgs, err = applyJavaHeap(args.JavaMemory, heap, executableArgs, logger)
+		if err != nil {
+			return 1, fmt.Errorf("unable to set the Java heap: %w", err)
+		}
+	}
+
+	var cmd *exec.Cmd
+	if args.Shell != "" {
+		cmd = exec.Command(args.Shell, executableArgs...)
+	} else {
+		cmd = exec.Command(executableArgs[0], executableArgs[1:]...)
+	}
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		logger.Error("Unable to get stdin", zap.Error(err))
+	}
+
+	var gate *readyGate
+	if args.ReadyLogPattern != "" || args.ReadyRcon {
+		gate = newReadyGate(stdin, logger.Named("ready"))
+		stdin = gate
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the websocket console stays up while the server stops, so clients see it stopping
+	websocketCtx, stopWebsocket := context.WithCancel(context.Background())
+	defer stopWebsocket()
+	errorChan := make(chan error, 1)
+	var backgroundFinished sync.WaitGroup
+
+	var limiter *loginlimit.Limiter
+	if args.WebsocketConsole || args.RemoteConsole {
+		limiter = loginlimit.New(loginlimit.Options{
+			MaxFailures:       args.LoginMaxFailures,
+			LockoutDuration:   args.LoginLockoutDuration,
+			MaxLockout:        args.LoginMaxLockoutDuration,
+			GlobalMaxFailures: args.LoginGlobalMaxFailures,
+			MaxSessionsPerIP:  args.LoginMaxSessionsPerIP,
+		}, logger.Named("login"))
+	}
+
+	output := hub.New(logger.Named("output"))
+	output.AddSink(hub.Stdout, r.stdout)
+	output.AddSink(hub.Stderr, r.stderr)
+
+	if args.WebsocketConsole {
+		var tlsConfig *tls.Config
+		if args.WebsocketTlsCert != "" {
+			reloader, err := newCertReloader(logger.Named("tls"), args.WebsocketTlsCert, args.WebsocketTlsKey, args.WebsocketTlsClientCa)
+			if err != nil {
+				return 1, fmt.Errorf("failed to setup websocket TLS: %w", err)
+			}
+			go reloader.watch(ctx)
+			tlsConfig = reloader.TLSConfig()
+		}
+
+		wsOverflowPolicy, err := hub.ParseOverflowPolicy(args.WebsocketOverflowPolicy)
+		if err != nil {
+			return 1, fmt.Errorf("invalid websocket overflow policy: %w", err)
+		}
+
+		wsServer := wsconsole.New(output, stdin, wsconsole.Options{
+			Address:            args.WebsocketAddress,
+			DisableAuth:        args.WebsocketDisableAuthentication,
+			DisableOriginCheck: args.WebsocketDisableOriginCheck,
+			TLSConfig:          tlsConfig,
+			SendQueueSize:      args.WebsocketSendQueueSize,
+			OverflowPolicy:     wsOverflowPolicy,
+			Limiter:            limiter,
+			Lifecycle:          serverLifecycle,
+			Reload:             r.config.Reload,
+			Settings:           websocketSettings(r.config.Get()),
+			Logger:             logger,
+		})
+		r.config.OnReload(func(current *runtimeConfig) {
+			wsServer.UpdateSettings(websocketSettings(current))
+		})
+
+		backgroundFinished.Add(1)
+		go func() {
+			defer backgroundFinished.Done()
+			if err := wsServer.Run(websocketCtx); err != nil {
+				errorChan <- err
+			}
+		}()
+	}
+
+	if args.RemoteConsole {
+		overflowPolicy, err := hub.ParseOverflowPolicy(args.RemoteConsoleOverflowPolicy)
+		if err != nil {
+			return 1, fmt.Errorf("invalid remote console overflow policy: %w", err)
+		}
+
+		historyDir := args.RemoteConsoleHistoryDir
+		if historyDir == "" {
+			if homeDir, err := os.UserHomeDir(); err == nil {
+				historyDir = filepath.Join(homeDir, ".console-history")
+			}
+		}
+		var sftpRoot string
+		if args.RemoteConsoleSftp {
+			sftpRoot = args.RemoteConsoleSftpRoot
+			if sftpRoot == "" {
+				sftpRoot, err = os.Getwd()
+				if err != nil {
+					return 1, fmt.Errorf("unable to determine SFTP root directory: %w", err)
+				}
+			}
+		}
+		sshServer := sshconsole.New(output, stdin, sshconsole.Options{
+			Prompt:            args.RemoteConsolePrompt,
+			HistoryDir:        historyDir,
+			HistorySize:       args.RemoteConsoleHistorySize,
+			ExecTimeout:       args.RemoteConsoleExecTimeout,
+			SftpRoot:          sftpRoot,
+			SftpOwner:         r.privileges.sftpOwner(),
+			SessionBufferSize: args.RemoteConsoleBufferSize,
+			OverflowPolicy:    overflowPolicy,
+			Limiter:           limiter,
+			Settings:          remoteConsoleSettings(r.config.Get()),
+			Logger:            logger,
+		})
+		// the authorized keys and RCON password may be changed by a reload
+		r.config.OnReload(func(current *runtimeConfig) {
+			sshServer.UpdateSettings(remoteConsoleSettings(current))
+		})
+
+		// Relay stdin between outside and server
+		if !args.DetachStdin && r.stdin != nil {
+			go consoleInRoutine(r.stdin, sshServer, logger)
+		}
+
+		go func() {
+			if err := sshServer.ListenAndServe(); err != nil {
+				errorChan <- fmt.Errorf("remote shell server failed: %w", err)
+			}
+		}()
+
+		logger.Info("Running with remote console support")
+	}
+
+	var readyOutput *hub.Subscription
+	if gate != nil && args.ReadyLogPattern != "" {
+		readyOutput = output.Subscribe("ready gate", bootstrapQueueSize, hub.DropOldest)
+	}
+
+	// without a ready gate, the server is considered ready once it logs that it's done starting
+	var lifecycleOutput *hub.Subscription
+	if gate == nil && args.WebsocketConsole {
+		lifecycleOutput = output.Subscribe("lifecycle", bootstrapQueueSize, hub.DropOldest)
+	}
+
+	var watchdogOutput *hub.Subscription
+	if args.WatchdogInterval > 0 {
+		watchdogOutput = output.Subscribe("watchdog", watchdogQueueSize, hub.DropOldest)
+	}
+
+	var bootstrapSteps []bootstrapStep
+	var bootstrapOutput *hub.Subscription
+	if args.Bootstrap != "" {
+		bootstrapContent, err := os.ReadFile(args.Bootstrap)
+		if err != nil {
+			logger.Error("Failed to read bootstrap commands", zap.Error(err))
+		} else if bootstrapSteps, err = parseBootstrap(bootstrapContent, strings.HasSuffix(args.Bootstrap, bootstrapTemplateExt)); err != nil {
+			logger.Error("Invalid bootstrap commands", zap.String("file", args.Bootstrap), zap.Error(err))
+		} else if hasWait(bootstrapSteps) {
+			bootstrapOutput = output.Subscribe("bootstrap", bootstrapQueueSize, hub.DropOldest)
+		}
+	}
+
+	var crashes *crashReporter
+	if !args.DisableCrashReport {
+		webhooks, err := parseWebhooks(args.CrashReportWebhooks)
+		if err != nil {
+			return 1, fmt.Errorf("invalid crash report webhooks: %w", err)
+		}
+		crashes = newCrashReporter(output, args.CrashReportLines, args.CrashReportDir, webhooks, logger.Named("crash"))
+	}
+
+	directOutput := !args.WebsocketConsole && !args.RemoteConsole && bootstrapOutput == nil && readyOutput == nil && watchdogOutput == nil && crashes == nil
+	if directOutput {
+		logger.Debug("Directly assigning stdout/stderr")
+		cmd.Stdout = r.stdout
+		cmd.Stderr = r.stderr
+	} else {
+		logger.Debug("Assigning output hub for stdout/stderr")
+		cmd.Stdout = output.Writer(hub.Stdout)
+		cmd.Stderr = output.Writer(hub.Stderr)
+	}
+
+	var dumper *threadDumper
+	if !args.DisableThreadDump {
+		dumper = &threadDumper{
+			dir:    args.ThreadDumpDir,
+			logger: logger.Named("thread-dump"),
+		}
+		if !directOutput {
+			dumper.output = output
+		}
+	}
+
+	if !args.RemoteConsole && r.stdin != nil {
+		// A terminal is still relayed, since the server runs in a background process group and
+		// would be stopped by SIGTTIN when reading from the terminal itself
+		if stdinFile, ok := r.stdin.(*os.File); ok && rconEnabled() && args.NamedPipe == "" && !args.WebsocketConsole && gate == nil &&
+			!term.IsTerminal(int(stdinFile.Fd())) {
+			logger.Debug("Directly assigning stdin")
+			cmd.Stdin = stdinFile
+			stdin = stdinFile
+		} else {
+			go relayStdin(logger, r.stdin, stdin)
+		}
+	}
+
+	var sendStop func(command string) error
+	if rconEnabled() {
+		sendStop = stopWithRconCli
+	}
+	server := supervisor.New(cmd, supervisor.Options{
+		Start:      r.start,
+		Clock:      r.clock,
+		Lifecycle:  serverLifecycle,
+		Stdin:      stdin,
+		SendStop:   sendStop,
+		BeforeKill: dumper.Capture,
+		Logger:     logger,
+	})
+	err = server.Start()
+	if err != nil {
+		return 1, fmt.Errorf("failed to start: %w", err)
+	}
+
+	if !args.DisableReaper {
+		supervisor.StartReaper(cmd.Process.Pid, logger.Named("reaper"))
+	}
+
+	if gate != nil {
+		var readyPattern *regexp.Regexp
+		if args.ReadyLogPattern != "" {
+			readyPattern = regexp.MustCompile(args.ReadyLogPattern)
+		}
+		go watchReady(ctx, gate, readyOutput, readyPattern, args.ReadyRcon, args.ReadyTimeout, args.ReadyTimeoutPolicy, serverLifecycle, logger.Named("ready"))
+	}
+	if lifecycleOutput != nil {
+		go watchServerDone(ctx, lifecycleOutput, serverLifecycle)
+	}
+
+	watchdogRestart := make(chan string, 1)
+	if watchdogOutput != nil {
+		wd := &watchdog{
+			interval:          args.WatchdogInterval,
+			timeout:           args.WatchdogTimeout,
+			probe:             args.WatchdogProbe,
+			probeCommand:      args.WatchdogProbeCommand,
+			probePattern:      regexp.MustCompile(args.WatchdogProbePattern),
+			overloadThreshold: args.WatchdogOverloadThreshold,
+			dumpAfter:         args.WatchdogDumpAfter,
+			restartAfter:      args.WatchdogRestartAfter,
+			healthFile:        args.WatchdogHealthFile,
+			stdin:             stdin,
+			output:            watchdogOutput,
+			cmd:               cmd,
+			dumper:            dumper,
+			logger:            logger.Named("watchdog"),
+		}
+		if gate != nil {
+			wd.ready = gate.Opened()
+		}
+		go wd.run(ctx, watchdogRestart)
+	}
+
+	if len(bootstrapSteps) > 0 {
+		go runBootstrap(ctx, bootstrapSteps, stdin, bootstrapOutput, logger.Named("bootstrap"))
+	} else if bootstrapOutput != nil {
+		bootstrapOutput.Unsubscribe()
+	}
+
+	if args.NamedPipe != "" {
+		err = handleNamedPipe(ctx, args.NamedPipe, stdin, errorChan)
+		if err != nil {
+			_ = server.Kill()
+			return 1, fmt.Errorf("failed to setup named pipe: %w", err)
+		}
+	}
+
+	cmdExitChan := make(chan int, 1)
+
+	go func() {
+		exitCode, stateBeforeExit, waitErr := server.Wait()
+		output.Close()
+		if crashes != nil && cmd.ProcessState != nil {
+			crashes.ReportIfAbnormal(cmd.ProcessState, stateBeforeExit)
+		}
+		if waitErr != nil {
+			logger.Error("Failed to wait on server process", zap.Error(waitErr))
+		} else if exitCode != 0 {
+			logger.Warn("Minecraft server failed. Inspect logs above for errors that indicate cause. DO NOT report this line as an error.",
+				zap.Int("exitCode", exitCode))
+			if exitCode == 137 {
+				logger.Error("Exit code 137 usually indicates the process was killed due to excessive memory use.")
+				logSystemMemory(logger)
+			}
+		}
+		cmdExitChan <- exitCode
+	}()
+
+	stop := func(stopArgs *Args) {
+		server.Stop(stopOptions(stopArgs, logger))
+	}
+
+	var timer supervisor.Timer
+	// watchdogStopped is set once the watchdog has stopped the server to have it restarted
+	watchdogStopped := false
+
+	for {
+		select {
+		case sig := <-r.signals:
+			name := signalName(sig)
+			action := r.signalActions[sig.(syscall.Signal)]
+			switch action.kind {
+			case signalStop:
+				logger.Debug(name + " caught")
+				logger.Info("gracefully stopping server...")
+				cancel()
+				stopArgs := r.config.Get().args
+				if stopArgs.StopServerAnnounceDelay > 0 {
+					serverLifecycle.Set(supervisor.StoppingAnnounced, name+" caught")
+					if stopArgs.StopServerDelayCommand == "" {
+						announceStop(logger, stdin, stopArgs.StopServerAnnounceDelay)
+					} else {
+						runStopDelayCommand(logger, stdin, stopArgs.StopServerDelayCommand)
+					}
+
+					logger.Info("Sleeping before server stop", zap.Duration("sleepTime", stopArgs.StopServerAnnounceDelay))
+					timer = r.clock.AfterFunc(stopArgs.StopServerAnnounceDelay, func() {
+						logger.Info("StopServerAnnounceDelay elapsed, stopping server")
+						stop(stopArgs)
+					})
+				} else {
+					stop(stopArgs)
+				}
+
+			case signalStopNow:
+				stopArgs := r.config.Get().args
+				if timer != nil {
+					if timer.Stop() {
+						logger.Info(name + " caught, bypassing running StopServerAnnounceDelay")
+						cancel()
+						stop(stopArgs)
+					} else {
+						logger.Info(name + " caught, StopServerAnnounceDelay already elapsed, server is already stopping")
+					}
+				} else {
+					logger.Info(name + " caught, gracefully stopping server... (without StopServerAnnounceDelay)")
+					cancel()
+					stop(stopArgs)
+				}
+
+			case signalReload:
+				logger.Info(name + " caught, reloading configuration")
+				if _, err := r.config.Reload(); err != nil {
+					logger.Error("Configuration reload rejected, keeping the previous configuration", zap.Error(err))
+				}
+
+			case signalForward:
+				logger.Info(name + " caught, forwarding to server process")
+				if err := cmd.Process.Signal(sig); err != nil {
+					logger.Error("Failed to forward signal to server process", zap.String("signal", name), zap.Error(err))
+				}
+
+			case signalCommand:
+				logger.Info(name+" caught, sending command to server", zap.String("command", action.command))
+				go func() {
+					if err := runConsoleCommand(stdin, action.command); err != nil {
+						logger.Error("Failed to send command to server", zap.String("command", action.command), zap.Error(err))
+					}
+				}()
+
+			case signalBackup:
+				logger.Info(name + " caught, running backup")
+				var backupOutput *hub.Hub
+				if !directOutput {
+					backupOutput = output
+				}
+				go runBackup(ctx, stdin, backupOutput, args.BackupCommand, logger.Named("backup"))
+
+			case signalIgnore:
+				logger.Debug(name + " caught, ignoring")
+			}
+
+		case reason := <-watchdogRestart:
+			logger.Error("Watchdog is stopping the unresponsive server so it can be restarted", zap.String("reason", reason))
+			serverLifecycle.Set(supervisor.Restarting, reason)
+			watchdogStopped = true
+			cancel()
+			server.Stop(watchdogStopOptions(r.config.Get().args, logger))
+
+		case backgroundErr := <-errorChan:
+			logger.Error("Error during background processing", zap.Error(backgroundErr))
+			serverLifecycle.Set(supervisor.Stopping, backgroundErr.Error())
+			cancel()
+			stop(r.config.Get().args)
+
+		case exitCode := <-cmdExitChan:
+			cancel()
+			stopWebsocket()
+			logger.Debug("Waiting on background processes to finish")
+			backgroundFinished.Wait()
+			if watchdogStopped && exitCode == 0 {
+				// a restart policy of on-failure wouldn't restart a server that stopped cleanly
+				logger.Info("Exiting with a failure since the watchdog stopped the server", zap.Int("exitCode", watchdogExitCode))
+				exitCode = watchdogExitCode
+			}
+			logger.Info("Done")
+			return exitCode, nil
+		}
+	}
+}
+
+// websocketSettings are the websocket console settings of the given configuration. The password
+// defaults to the RCON password.
+func websocketSettings(current *runtimeConfig) wsconsole.Settings {
+	password := current.args.WebsocketPassword
+	if password == "" {
+		password = rconClient().Password()
+	}
+	return wsconsole.Settings{
+		Password:            password,
+		AllowedOrigins:      current.allowedOrigins,
+		AllowSameHostOrigin: current.args.WebsocketAllowSameHostOrigin,
+		LogBufferSize:       current.args.WebsocketLogBufferSize,
+	}
+}
+
+// remoteConsoleSettings are the remote console settings of the given configuration, which use
+// the RCON password
+func remoteConsoleSettings(current *runtimeConfig) sshconsole.Settings {
+	return sshconsole.Settings{
+		Password:       rconClient().Password(),
+		AuthorizedKeys: current.authorizedKeys,
+	}
+}
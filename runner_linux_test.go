@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// ptyHelperEnv marks the test process that runs the runner with a pty as its controlling terminal
+const ptyHelperEnv = "MC_SERVER_RUNNER_TEST_PTY_HELPER"
+
+// openPty opens a new pseudo terminal and returns its master and slave ends
+func openPty(t *testing.T) (*os.File, *os.File) {
+	t.Helper()
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skip("unable to open a pty:", err)
+	}
+	t.Cleanup(func() { master.Close() })
+
+	if err := unix.IoctlSetPointerInt(int(master.Fd()), unix.TIOCSPTLCK, 0); err != nil {
+		t.Fatal(err)
+	}
+	n, err := unix.IoctlGetUint32(int(master.Fd()), unix.TIOCGPTN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	slave, err := os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return master, slave
+}
+
+// TestRunnerTerminalStdin runs the runner, in a test process of its own, with a pty as its
+// stdin and controlling terminal, as with docker run -it. The server runs in a background
+// process group and must still receive what is typed.
+func TestRunnerTerminalStdin(t *testing.T) {
+	if os.Getenv(ptyHelperEnv) != "" {
+		runWithTerminalStdin(t)
+		return
+	}
+
+	master, slave := openPty(t)
+	helper := exec.Command(os.Args[0], "-test.run=^TestRunnerTerminalStdin$")
+	helper.Env = append(os.Environ(), ptyHelperEnv+"=1")
+	helper.Stdin, helper.Stdout, helper.Stderr = slave, slave, slave
+	helper.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	if err := helper.Start(); err != nil {
+		t.Fatal(err)
+	}
+	slave.Close()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- helper.Wait()
+	}()
+	t.Cleanup(func() {
+		_ = helper.Process.Kill()
+	})
+
+	terminal := &syncBuffer{}
+	go io.Copy(terminal, master)
+	waitForOutput(t, terminal, "Ready for commands")
+	if _, err := master.Write([]byte("stop\n")); err != nil {
+		t.Fatal(err)
+	}
+	waitForOutput(t, terminal, "Stopping the server")
+
+	select {
+	case err := <-exited:
+		if err != nil {
+			t.Errorf("runner failed: %s, terminal:\n%s", err, terminal.String())
+		}
+	case <-time.After(runnerTestTimeout):
+		t.Fatalf("timed out waiting for the runner to exit, terminal:\n%s", terminal.String())
+	}
+}
+
+// runWithTerminalStdin runs the server with the runner's own standard streams, which are the pty,
+// where stdin would be given to the server directly if it weren't a terminal
+func runWithTerminalStdin(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "rcon-cli"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("ENABLE_RCON", "TRUE")
+
+	runner, _, _ := testRunner(t)
+	runner.stdin, runner.stdout, runner.stderr = os.Stdin, os.Stdout, os.Stderr
+	result := waitForRunner(t, startRunner(runner, "test/stop.sh"))
+	if result.exitCode != 0 {
+		t.Errorf("expected exit code 0, got %d", result.exitCode)
+	}
+}
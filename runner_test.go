@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/itzg/go-flagsfiller"
+	"github.com/itzg/mc-server-runner/supervisor"
+	"github.com/itzg/mc-server-runner/supervisor/supervisortest"
+	"go.uber.org/zap"
+)
+
+// runnerTestTimeout bounds how long each test waits on the runner or the server's output
+const runnerTestTimeout = 10 * time.Second
+
+// syncBuffer collects the server's output while the test reads it
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestMain(m *testing.M) {
+	// the runner starts the test binary as its wrapper when applying the server-* settings
+	execServerIfWrapper()
+	os.Exit(m.Run())
+}
+
+type runnerResult struct {
+	exitCode int
+	err      error
+}
+
+// testRunner sets up a runner with the given flags that receives the returned signal channel
+// instead of the process's signals and collects the server's output
+func testRunner(t *testing.T, flags ...string) (*Runner, chan os.Signal, *syncBuffer) {
+	t.Helper()
+
+	var args Args
+	flagSet := flag.NewFlagSet(t.Name(), flag.ContinueOnError)
+	flagSet.SetOutput(io.Discard)
+	if err := flagsfiller.New().Fill(flagSet, &args); err != nil {
+		t.Fatal(err)
+	}
+	defaults := []string{
+		"--disable-reaper",
+		"--disable-crash-report",
+		"--disable-thread-dump",
+	}
+	if err := flagSet.Parse(append(defaults, flags...)); err != nil {
+		t.Fatal(err)
+	}
+
+	logger := zap.NewNop()
+	config, err := newLiveConfig(&args, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runner, err := newRunner(config, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signals := make(chan os.Signal, 1)
+	output := &syncBuffer{}
+	runner.signals = signals
+	runner.stdin = nil
+	runner.stdout = output
+	runner.stderr = output
+	return runner, signals, output
+}
+
+func startRunner(runner *Runner, executableArgs ...string) <-chan runnerResult {
+	done := make(chan runnerResult, 1)
+	go func() {
+		exitCode, err := runner.Run(executableArgs)
+		done <- runnerResult{exitCode: exitCode, err: err}
+	}()
+	return done
+}
+
+func waitForRunner(t *testing.T, done <-chan runnerResult) runnerResult {
+	t.Helper()
+	select {
+	case result := <-done:
+		if result.err != nil {
+			t.Fatal(result.err)
+		}
+		return result
+	case <-time.After(runnerTestTimeout):
+		t.Fatal("timed out waiting for the runner to finish")
+		return runnerResult{}
+	}
+}
+
+func waitForOutput(t *testing.T, output *syncBuffer, expected string) {
+	t.Helper()
+	deadline := time.Now().Add(runnerTestTimeout)
+	for !strings.Contains(output.String(), expected) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %q in output:\n%s", expected, output.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRunnerExitCode(t *testing.T) {
+	for _, code := range []int{0, 3} {
+		runner, _, _ := testRunner(t)
+		result := waitForRunner(t, startRunner(runner, "test/exit-with-code.sh", strconv.Itoa(code)))
+		if result.exitCode != code {
+			t.Errorf("expected exit code %d, got %d", code, result.exitCode)
+		}
+		if state := runner.lifecycle.Current(); state.State != supervisor.Exited || *state.ExitCode != code {
+			t.Errorf("expected exited with %d, got %s", code, state.State)
+		}
+	}
+}
+
+func TestRunnerGracefulStop(t *testing.T) {
+	runner, signals, output := testRunner(t)
+	done := startRunner(runner, "test/stop.sh")
+	waitForOutput(t, output, "Ready for commands")
+
+	signals <- syscall.SIGTERM
+	result := waitForRunner(t, done)
+	if result.exitCode != 0 {
+		t.Errorf("expected exit code 0, got %d", result.exitCode)
+	}
+	if !strings.Contains(output.String(), "Stopping the server") {
+		t.Errorf("expected the server to receive stop, output:\n%s", output.String())
+	}
+	if previous := runner.lifecycle.Current().Previous; previous != supervisor.Stopping {
+		t.Errorf("expected to exit while stopping, got %s", previous)
+	}
+}
+
+func TestRunnerForcedKill(t *testing.T) {
+	runner, signals, output := testRunner(t, "--stop-duration=100ms")
+	done := startRunner(runner, "bash", "test/sleep.sh")
+	waitForOutput(t, output, "Sleeping")
+
+	signals <- syscall.SIGTERM
+	result := waitForRunner(t, done)
+	if result.exitCode == 0 {
+		t.Error("expected a non-zero exit code after killing the server")
+	}
+	if previous := runner.lifecycle.Current().Previous; previous != supervisor.Killing {
+		t.Errorf("expected to exit while killing, got %s", previous)
+	}
+}
+
+func TestRunnerThreadDumpInWorkingDirectory(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the java process is only recognized on linux")
+	}
+	script, err := filepath.Abs("test/hang.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// SIGQUIT is only sent to java, so run the script with a copy of bash by that name
+	java := filepath.Join(t.TempDir(), "java")
+	copyExecutable(t, "bash", java)
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	// the crash report routes the output through the hub, where the printed threads are captured
+	runner, signals, output := testRunner(t, "--disable-thread-dump=false", "--disable-crash-report=false", "--stop-duration=100ms")
+	done := startRunner(runner, java, script)
+	waitForOutput(t, output, "Hanging")
+
+	signals <- syscall.SIGTERM
+	waitForRunner(t, done)
+
+	dumps, err := filepath.Glob(filepath.Join(dir, "thread-dump-*.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dumps) != 1 {
+		t.Fatalf("expected a thread dump in the working directory, found %v", dumps)
+	}
+	dump, err := os.ReadFile(dumps[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(dump), "Full thread dump") {
+		t.Errorf("expected the printed threads in the dump, got:\n%s", dump)
+	}
+}
+
+func TestRunnerThreadDumpSkipsShell(t *testing.T) {
+	if _, err := exec.LookPath("jcmd"); err == nil {
+		t.Skip("jcmd is used when installed")
+	}
+	script, err := filepath.Abs("test/hang.sh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	t.Chdir(dir)
+
+	runner, signals, output := testRunner(t, "--disable-thread-dump=false", "--disable-crash-report=false", "--stop-duration=100ms")
+	done := startRunner(runner, script)
+	waitForOutput(t, output, "Hanging")
+
+	signals <- syscall.SIGTERM
+	waitForRunner(t, done)
+
+	if dumps, _ := filepath.Glob(filepath.Join(dir, "thread-dump-*.txt")); len(dumps) != 0 {
+		t.Errorf("expected no SIGQUIT thread dump of a shell script, found %v", dumps)
+	}
+	if strings.Contains(output.String(), "Full thread dump") {
+		t.Error("expected the shell script to not receive SIGQUIT")
+	}
+}
+
+// copyExecutable copies the named executable from the PATH
+func copyExecutable(t *testing.T, name string, dest string) {
+	t.Helper()
+	path, err := exec.LookPath(name)
+	if err != nil {
+		t.Skip(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(dest, content, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRunnerAnnounceDelay(t *testing.T) {
+	runner, signals, output := testRunner(t, "--stop-server-announce-delay=30s")
+	clock := &supervisortest.Clock{}
+	runner.clock = clock
+	done := startRunner(runner, "test/stop.sh")
+	waitForOutput(t, output, "Ready for commands")
+
+	signals <- syscall.SIGTERM
+	waitForOutput(t, output, "say Server shutting down in 30 seconds")
+	if state := runner.lifecycle.Current().State; state != supervisor.StoppingAnnounced {
+		t.Errorf("expected %s during the announce delay, got %s", supervisor.StoppingAnnounced, state)
+	}
+
+	clock.Advance(29 * time.Second)
+	select {
+	case <-done:
+		t.Fatal("server stopped before the announce delay elapsed")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	clock.Advance(time.Second)
+	result := waitForRunner(t, done)
+	if result.exitCode != 0 {
+		t.Errorf("expected exit code 0, got %d", result.exitCode)
+	}
+	if !strings.Contains(output.String(), "Stopping the server") {
+		t.Errorf("expected the server to receive stop, output:\n%s", output.String())
+	}
+}
+
+func TestRunnerStopNowBypassesAnnounceDelay(t *testing.T) {
+	runner, signals, output := testRunner(t, "--stop-server-announce-delay=30s")
+	runner.clock = &supervisortest.Clock{}
+	done := startRunner(runner, "test/stop.sh")
+	waitForOutput(t, output, "Ready for commands")
+
+	signals <- syscall.SIGTERM
+	waitForOutput(t, output, "say Server shutting down")
+	signals <- syscall.SIGUSR1
+
+	result := waitForRunner(t, done)
+	if result.exitCode != 0 {
+		t.Errorf("expected exit code 0, got %d", result.exitCode)
+	}
+	if !strings.Contains(output.String(), "Stopping the server") {
+		t.Errorf("expected the server to receive stop, output:\n%s", output.String())
+	}
+}
+
+func TestRunnerNamedPipe(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("named pipes are only supported on Linux")
+	}
+
+	pipePath := filepath.Join(t.TempDir(), "console")
+	runner, signals, output := testRunner(t, "--named-pipe="+pipePath, "--stop-duration=100ms")
+	done := startRunner(runner, "test/echo.sh")
+	waitForOutput(t, output, "Ready to echo stdin")
+
+	pipe, err := os.OpenFile(pipePath, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pipe.WriteString("say hello from the pipe\n"); err != nil {
+		t.Fatal(err)
+	}
+	pipe.Close()
+	waitForOutput(t, output, "say hello from the pipe")
+
+	signals <- syscall.SIGTERM
+	waitForRunner(t, done)
+}
+
+func TestRunnerStartFailure(t *testing.T) {
+	runner, _, _ := testRunner(t)
+	runner.start = func(cmd *exec.Cmd) error {
+		return errors.New("not allowed")
+	}
+
+	select {
+	case result := <-startRunner(runner, "bash", "test/sleep.sh"):
+		if result.err == nil || !strings.Contains(result.err.Error(), "not allowed") {
+			t.Errorf("expected the start error, got %v", result.err)
+		}
+	case <-time.After(runnerTestTimeout):
+		t.Fatal("timed out waiting for the runner to fail")
+	}
+}
+
+func TestWatchdogStopOptionsBoundStopDuration(t *testing.T) {
+	tests := []struct {
+		stopDuration time.Duration
+		expected     time.Duration
+	}{
+		{0, 30 * time.Second},
+		{10 * time.Second, 10 * time.Second},
+		{5 * time.Minute, 30 * time.Second},
+	}
+	for _, tt := range tests {
+		args := &Args{StopDuration: tt.stopDuration, WatchdogStopDuration: 30 * time.Second}
+		if got := watchdogStopOptions(args, zap.NewNop()).Duration; got != tt.expected {
+			t.Errorf("stop duration %s: expected %s, got %s", tt.stopDuration, tt.expected, got)
+		}
+	}
+}
+
+func TestRunnerWatchdogRestartExitsWithFailure(t *testing.T) {
+	// stop.sh echoes the probe command rather than listing players, which fails the check
+	runner, _, output := testRunner(t,
+		"--ready-log-pattern=Ready for commands",
+		"--watchdog-interval=100ms",
+		"--watchdog-timeout=100ms",
+		"--watchdog-dump-after=0",
+		"--watchdog-restart-after=1")
+	done := startRunner(runner, "test/stop.sh")
+
+	result := waitForRunner(t, done)
+	if !strings.Contains(output.String(), "Stopping the server") {
+		t.Errorf("expected the server to receive stop, output:\n%s", output.String())
+	}
+	if result.exitCode != watchdogExitCode {
+		t.Errorf("expected exit code %d after the server stopped cleanly, got %d", watchdogExitCode, result.exitCode)
+	}
+}
+
+func TestIgnoredSignalsAreNotInheritedByServer(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("reads the ignored signals from /proc")
+	}
+
+	actions, err := parseSignalActions([]string{"SIGTERM=ignore"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signals := make(chan os.Signal, 1)
+	notifySignals(signals, actions)
+	defer signal.Reset()
+
+	out, err := exec.Command("grep", "SigIgn", "/proc/self/status").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mask, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(string(out), "SigIgn:")), 16, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sig := range []syscall.Signal{syscall.SIGTERM, syscall.SIGUSR2} {
+		if mask&(1<<(uint(sig)-1)) != 0 {
+			t.Errorf("expected the server to inherit the default handling of %s", signalName(sig))
+		}
+	}
+}
+
+func TestRunnerRaisesLimitsBeforeSwitchingUser(t *testing.T) {
+	if runtime.GOOS != "linux" || os.Geteuid() != 0 {
+		t.Skip("switching the server's user needs root on linux")
+	}
+	var current syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &current); err != nil {
+		t.Fatal(err)
+	}
+	// raising the hard limit is only allowed while still privileged, given CAP_SYS_RESOURCE
+	limit := current.Max
+	if hasCapability(t, 24) {
+		limit += 1024
+	}
+	raised := strconv.FormatUint(limit, 10)
+	// the server's user may not be able to access the working directory
+	t.Chdir("/")
+
+	runner, _, output := testRunner(t, "--server-user=65534", "--server-group=65534", "--server-rlimit-nofile="+raised)
+	result := waitForRunner(t, startRunner(runner, "/bin/sh", "-c", `echo "uid=$(id -u) nofile=$(ulimit -Hn)"`))
+	if result.exitCode != 0 {
+		t.Fatalf("expected exit code 0, got %d, output:\n%s", result.exitCode, output.String())
+	}
+	if expected := "uid=65534 nofile=" + raised; !strings.Contains(output.String(), expected) {
+		t.Errorf("expected %q, got:\n%s", expected, output.String())
+	}
+}
+
+// hasCapability reports if the test has the given capability, such as 24 for CAP_SYS_RESOURCE
+func hasCapability(t *testing.T, capability uint) bool {
+	t.Helper()
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if value, found := strings.CutPrefix(line, "CapEff:"); found {
+			effective, err := strconv.ParseUint(strings.TrimSpace(value), 16, 64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return effective&(1<<capability) != 0
+		}
+	}
+	return false
+}
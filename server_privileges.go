@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/itzg/mc-server-runner/sshconsole"
+)
+
+// rlimitUnlimited is RLIM_INFINITY
+const rlimitUnlimited = math.MaxUint64
+
+// serverPrivileges are applied to the server process as it starts, while the runner itself
+// keeps its own user and limits
+type serverPrivileges struct {
+	// switchUser is set when the server runs as uid and gid
+	switchUser bool
+	uid        uint32
+	gid        uint32
+	groups     []uint32
+	// home is the home directory of the server's user, when known
+	home string
+
+	noNewPrivs bool
+	// umask is -1 to keep the runner's umask
+	umask int
+
+	rlimitNofile *serverRlimit
+	rlimitCore   *serverRlimit
+}
+
+type serverRlimit struct {
+	soft uint64
+	hard uint64
+}
+
+// parseServerPrivileges resolves the server-* user, group and limit settings
+func parseServerPrivileges(args *Args) (*serverPrivileges, error) {
+	privileges := &serverPrivileges{
+		noNewPrivs: args.ServerNoNewPrivs,
+		umask:      -1,
+	}
+
+	if args.ServerUser != "" {
+		if err := privileges.resolveUser(args.ServerUser, args.ServerGroup, args.ServerSupplementaryGroups); err != nil {
+			return nil, err
+		}
+	} else if args.ServerGroup != "" || hasListSetting(args.ServerSupplementaryGroups) {
+		return nil, fmt.Errorf("server-group and server-supplementary-groups require server-user")
+	}
+
+	if args.ServerUmask != "" {
+		umask, err := strconv.ParseUint(args.ServerUmask, 8, 32)
+		if err != nil || umask > 0777 {
+			return nil, fmt.Errorf("server-umask: '%s' isn't an octal umask such as 0027", args.ServerUmask)
+		}
+		privileges.umask = int(umask)
+	}
+
+	var err error
+	if privileges.rlimitNofile, err = parseRlimit(args.ServerRlimitNofile); err != nil {
+		return nil, fmt.Errorf("server-rlimit-nofile: %w", err)
+	}
+	if privileges.rlimitCore, err = parseRlimit(args.ServerRlimitCore); err != nil {
+		return nil, fmt.Errorf("server-rlimit-core: %w", err)
+	}
+	return privileges, nil
+}
+
+// resolveUser looks up the user and groups by name or id. Like gosu, the group and supplementary
+// groups default to those of the user when it is known to the system.
+func (p *serverPrivileges) resolveUser(userValue string, groupValue string, supplementaryGroups []string) error {
+	p.switchUser = true
+
+	var known *user.User
+	if uid, err := strconv.ParseUint(userValue, 10, 32); err == nil {
+		p.uid = uint32(uid)
+		// an unknown uid is still usable, but then the group has to be given
+		known, _ = user.LookupId(userValue)
+	} else {
+		known, err = user.Lookup(userValue)
+		if err != nil {
+			return fmt.Errorf("server-user: %w", err)
+		}
+		uid, err := strconv.ParseUint(known.Uid, 10, 32)
+		if err != nil {
+			return fmt.Errorf("server-user: unsupported uid '%s'", known.Uid)
+		}
+		p.uid = uint32(uid)
+	}
+	if known != nil {
+		p.home = known.HomeDir
+	}
+
+	switch {
+	case groupValue != "":
+		gid, err := lookupGid(groupValue)
+		if err != nil {
+			return fmt.Errorf("server-group: %w", err)
+		}
+		p.gid = gid
+	case known != nil:
+		gid, err := strconv.ParseUint(known.Gid, 10, 32)
+		if err != nil {
+			return fmt.Errorf("server-user: unsupported gid '%s'", known.Gid)
+		}
+		p.gid = uint32(gid)
+	default:
+		return fmt.Errorf("server-group is required since uid %d isn't a known user", p.uid)
+	}
+
+	if hasListSetting(supplementaryGroups) {
+		for _, group := range supplementaryGroups {
+			if strings.TrimSpace(group) == "" {
+				continue
+			}
+			gid, err := lookupGid(strings.TrimSpace(group))
+			if err != nil {
+				return fmt.Errorf("server-supplementary-groups: %w", err)
+			}
+			p.groups = append(p.groups, gid)
+		}
+	} else if known != nil {
+		groupIds, err := known.GroupIds()
+		if err != nil {
+			return fmt.Errorf("server-user: unable to look up groups of %s: %w", known.Username, err)
+		}
+		for _, groupId := range groupIds {
+			gid, err := strconv.ParseUint(groupId, 10, 32)
+			if err != nil {
+				continue
+			}
+			p.groups = append(p.groups, uint32(gid))
+		}
+	}
+	return nil
+}
+
+func lookupGid(value string) (uint32, error) {
+	if gid, err := strconv.ParseUint(value, 10, 32); err == nil {
+		return uint32(gid), nil
+	}
+	group, err := user.LookupGroup(value)
+	if err != nil {
+		return 0, err
+	}
+	gid, err := strconv.ParseUint(group.Gid, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unsupported gid '%s'", group.Gid)
+	}
+	return uint32(gid), nil
+}
+
+// parseRlimit parses a limit given as soft[:hard], where either may be unlimited.
+// A single value sets both. An empty value leaves the limit as is and returns nil.
+func parseRlimit(value string) (*serverRlimit, error) {
+	if value == "" {
+		return nil, nil
+	}
+	softValue, hardValue, hasHard := strings.Cut(value, ":")
+	soft, err := parseRlimitValue(softValue)
+	if err != nil {
+		return nil, err
+	}
+	hard := soft
+	if hasHard {
+		hard, err = parseRlimitValue(hardValue)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if soft > hard {
+		return nil, fmt.Errorf("soft limit %s is above the hard limit %s", softValue, hardValue)
+	}
+	return &serverRlimit{soft: soft, hard: hard}, nil
+}
+
+func parseRlimitValue(value string) (uint64, error) {
+	value = strings.TrimSpace(value)
+	if value == "unlimited" {
+		return rlimitUnlimited, nil
+	}
+	limit, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid limit '%s', expected a number or unlimited", value)
+	}
+	return limit, nil
+}
+
+// hasListSetting reports whether a list setting has any non-blank entries
+func hasListSetting(values []string) bool {
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// sftpOwner is the owner of files created over SFTP, so that the server can use them when it
+// runs as another user
+func (p *serverPrivileges) sftpOwner() *sshconsole.FileOwner {
+	if p == nil || !p.switchUser {
+		return nil
+	}
+	return &sshconsole.FileOwner{UID: int(p.uid), GID: int(p.gid)}
+}
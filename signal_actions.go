@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/itzg/mc-server-runner/hub"
+	"github.com/itzg/mc-server-runner/supervisor"
+	"go.uber.org/zap"
+)
+
+type signalActionKind string
+
+const (
+	// signalStop gracefully stops the server, including the stop announcement delay
+	signalStop signalActionKind = "stop"
+	// signalStopNow gracefully stops the server without, or cutting short, the announcement delay
+	signalStopNow signalActionKind = "stop-now"
+	// signalReload reloads the configuration
+	signalReload signalActionKind = "reload"
+	// signalForward sends the same signal to the server process
+	signalForward signalActionKind = "forward"
+	// signalCommand sends a command, given after a colon, to the server console
+	signalCommand signalActionKind = "command"
+	// signalBackup runs the backup command while the server has saving turned off
+	signalBackup signalActionKind = "backup"
+	// signalIgnore ignores the signal
+	signalIgnore signalActionKind = "ignore"
+)
+
+type signalAction struct {
+	kind signalActionKind
+	// command is sent to the console by the command action
+	command string
+}
+
+var actionSignals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGUSR1": syscall.SIGUSR1,
+	"SIGUSR2": syscall.SIGUSR2,
+}
+
+// defaultSignalActions apply to each signal not given in the signal-actions setting
+var defaultSignalActions = map[syscall.Signal]signalAction{
+	// docker stop sends a SIGTERM, so intercept that and send a 'stop' command to the server
+	syscall.SIGTERM: {kind: signalStop},
+	// Ctrl-C with docker run -it
+	syscall.SIGINT: {kind: signalStop},
+	// SIGUSR1 bypasses StopServerAnnounceDelay (in cases where SIGTERM has **and** hasn't been sent)
+	syscall.SIGUSR1: {kind: signalStopNow},
+	syscall.SIGHUP:  {kind: signalReload},
+	// the JVM prints a thread dump on SIGQUIT
+	syscall.SIGQUIT: {kind: signalForward},
+	syscall.SIGUSR2: {kind: signalIgnore},
+}
+
+// parseSignalActions applies entries such as "SIGUSR2=command:save-all" or "SIGQUIT=ignore"
+// over the default actions
+func parseSignalActions(entries []string) (map[syscall.Signal]signalAction, error) {
+	actions := map[syscall.Signal]signalAction{}
+	for sig, action := range defaultSignalActions {
+		actions[sig] = action
+	}
+
+	for _, entry := range entries {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		name, actionValue, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid entry '%s', expected SIGNAL=ACTION", entry)
+		}
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if !strings.HasPrefix(name, "SIG") {
+			name = "SIG" + name
+		}
+		sig, ok := actionSignals[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported signal '%s', expected one of SIGTERM, SIGINT, SIGHUP, SIGQUIT, SIGUSR1 or SIGUSR2", name)
+		}
+
+		kind, command, _ := strings.Cut(strings.TrimSpace(actionValue), ":")
+		action := signalAction{kind: signalActionKind(kind), command: strings.TrimSpace(command)}
+		switch action.kind {
+		case signalCommand:
+			if action.command == "" {
+				return nil, fmt.Errorf("%s: the command action needs a command, such as command:save-all", name)
+			}
+		case signalStop, signalStopNow, signalReload, signalForward, signalBackup, signalIgnore:
+			if action.command != "" {
+				return nil, fmt.Errorf("%s: only the command action takes a command", name)
+			}
+		default:
+			return nil, fmt.Errorf("%s: unknown action '%s', expected stop, stop-now, reload, forward, command, backup or ignore", name, kind)
+		}
+		actions[sig] = action
+	}
+	return actions, nil
+}
+
+// notifySignals registers for every signal with an action. Ignored signals are registered too and
+// dropped when received, since signal.Ignore would have the server inherit them as ignored.
+func notifySignals(signalChan chan<- os.Signal, actions map[syscall.Signal]signalAction) {
+	for sig := range actions {
+		signal.Notify(signalChan, sig)
+	}
+}
+
+func signalName(sig os.Signal) string {
+	for name, s := range actionSignals {
+		if s == sig {
+			return name
+		}
+	}
+	if s, ok := sig.(syscall.Signal); ok {
+		return supervisor.StopSignalName(s)
+	}
+	return sig.String()
+}
+
+// runConsoleCommand sends one command to the server via RCON when available, otherwise to stdin
+func runConsoleCommand(stdin io.Writer, command string) error {
+	if rconEnabled() {
+		return rconClient().Command(context.Background(), command)
+	}
+	_, err := stdin.Write([]byte(command + "\n"))
+	return err
+}
+
+const (
+	// backupSaveTimeout limits how long a backup waits for the server to finish saving
+	backupSaveTimeout = time.Minute
+	// backupSaveWait is how long a backup waits for the server to save when its output can't be watched
+	backupSaveWait = 10 * time.Second
+)
+
+var backupSavedPattern = regexp.MustCompile(`Saved the game`)
+
+// backupRunning prevents overlapping backups when the signal is sent repeatedly
+var backupRunning atomic.Bool
+
+// runBackup turns off saving, has the server save everything, runs the backup command and then
+// turns saving back on. output may be nil when the server output isn't routed through the hub.
+func runBackup(ctx context.Context, stdin io.Writer, output *hub.Hub, backupCommand string, logger *zap.Logger) {
+	if backupCommand == "" {
+		logger.Warn("Backup requested, but no backup command is configured")
+		return
+	}
+	if !backupRunning.CompareAndSwap(false, true) {
+		logger.Warn("Backup requested while one is already running")
+		return
+	}
+	defer backupRunning.Store(false)
+
+	var sub *hub.Subscription
+	if output != nil {
+		sub = output.Subscribe("backup", bootstrapQueueSize, hub.DropOldest)
+		defer sub.Unsubscribe()
+	}
+
+	logger.Info("Starting backup")
+	for _, command := range []string{"save-off", "save-all flush"} {
+		if err := runConsoleCommand(stdin, command); err != nil {
+			logger.Error("Failed to prepare server for backup", zap.String("command", command), zap.Error(err))
+			return
+		}
+	}
+	defer func() {
+		if err := runConsoleCommand(stdin, "save-on"); err != nil {
+			logger.Error("Failed to turn saving back on after backup", zap.Error(err))
+		}
+	}()
+
+	if sub != nil {
+		saved := make(chan struct{})
+		go func() {
+			for {
+				chunk, ok := sub.Pop()
+				if !ok {
+					return
+				}
+				if backupSavedPattern.Match(chunk.Data) {
+					close(saved)
+					return
+				}
+			}
+		}()
+		select {
+		case <-saved:
+		case <-time.After(backupSaveTimeout):
+			logger.Warn("Server didn't confirm saving before backup, continuing anyway")
+		case <-ctx.Done():
+			return
+		}
+	} else {
+		time.Sleep(backupSaveWait)
+	}
+
+	backup := exec.CommandContext(ctx, "sh", "-c", backupCommand)
+	backup.Stdout = os.Stdout
+	backup.Stderr = os.Stderr
+	start := time.Now()
+	if err := backup.Run(); err != nil {
+		logger.Error("Backup command failed", zap.Error(err))
+		return
+	}
+	logger.Info("Backup complete", zap.Duration("duration", time.Since(start)))
+}
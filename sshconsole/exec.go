@@ -0,0 +1,131 @@
+package sshconsole
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	// execExpectEnv is the SSH environment variable that sets a regex to wait for in exec mode
+	execExpectEnv = "MC_EXPECT"
+	// execTimeoutEnv is the SSH environment variable that overrides the exec mode capture window
+	execTimeoutEnv = "MC_TIMEOUT"
+)
+
+// execDrainTimeout limits how long an exec session waits for its remaining output to be written
+const execDrainTimeout = time.Second
+
+const (
+	execExitOk         = 0
+	execExitNotMatched = 1
+	execExitFailed     = 2
+)
+
+// outputMatcher signals once a line of output matches the expected pattern
+type outputMatcher struct {
+	pattern *regexp.Regexp
+	matched chan struct{}
+	once    sync.Once
+}
+
+func (m *outputMatcher) observe(p []byte) {
+	if m.pattern.Match(p) {
+		m.once.Do(func() { close(m.matched) })
+	}
+}
+
+func sessionEnv(session ssh.Session, name string) (string, bool) {
+	for _, entry := range session.Environ() {
+		if key, value, found := strings.Cut(entry, "="); found && key == name {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// handleExec runs a one-shot command, such as from `ssh -p 2222 host "say hi"`. The command is sent
+// to the server and its output relayed to the client until the capture window elapses or, when the
+// client set MC_EXPECT, until a line matches that regex. The exit status is 0 on success, 1 if the
+// expected output was not seen in time, and 2 if the command could not be run.
+func (s *Server) handleExec(session ssh.Session, filter *outputFilter) {
+	logger := s.logger
+	command := strings.TrimSpace(session.RawCommand())
+	logger.Info(fmt.Sprintf("Remote console exec accepted (%s/%s)", session.User(), session.RemoteAddr().String()),
+		zap.String("command", command))
+
+	timeout := s.opts.ExecTimeout
+	if value, ok := sessionEnv(session, execTimeoutEnv); ok {
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			fmt.Fprintf(session.Stderr(), "Invalid %s: %s\n", execTimeoutEnv, err)
+			session.Exit(execExitFailed)
+			return
+		}
+		timeout = parsed
+	}
+
+	var matcher *outputMatcher
+	if value, ok := sessionEnv(session, execExpectEnv); ok && value != "" {
+		pattern, err := regexp.Compile(value)
+		if err != nil {
+			fmt.Fprintf(session.Stderr(), "Invalid %s: %s\n", execExpectEnv, err)
+			session.Exit(execExitFailed)
+			return
+		}
+		matcher = &outputMatcher{
+			pattern: pattern,
+			matched: make(chan struct{}),
+		}
+	}
+
+	sessionId := uuid.New()
+	cs := &consoleSession{
+		session: session,
+		filter:  filter,
+		matcher: matcher,
+	}
+	s.registerSession(sessionId, cs)
+	defer s.unregisterSession(sessionId)
+
+	_, err := s.WriteToStdIn([]byte(command + "\n"))
+	if err != nil {
+		logger.Error(fmt.Sprintf("Session failed to write to stdin (%s/%s)", session.User(), session.RemoteAddr().String()), zap.Error(err))
+		fmt.Fprintln(session.Stderr(), "Failed to send command to server")
+		session.Exit(execExitFailed)
+		return
+	}
+
+	exitCode := execExitOk
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	if matcher != nil {
+		select {
+		case <-matcher.matched:
+		case <-timer.C:
+			exitCode = execExitNotMatched
+		case <-session.Context().Done():
+			return
+		}
+	} else {
+		select {
+		case <-timer.C:
+		case <-session.Context().Done():
+			return
+		}
+	}
+
+	// let the output captured so far reach the client before exiting
+	s.unregisterSession(sessionId)
+	select {
+	case <-cs.drained:
+	case <-time.After(execDrainTimeout):
+	}
+	session.Exit(exitCode)
+}
@@ -0,0 +1,248 @@
+package sshconsole
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/itzg/mc-server-runner/hub"
+)
+
+const (
+	filterLevelEnv   = "MC_LEVEL"
+	filterIncludeEnv = "MC_INCLUDE"
+	filterExcludeEnv = "MC_EXCLUDE"
+	filterStreamEnv  = "MC_STREAM"
+)
+
+// escapeCommandPrefix marks a line typed into a remote console as a command for the session itself,
+// rather than for the server
+const escapeCommandPrefix = ":"
+
+type logLevel int
+
+const (
+	levelTrace logLevel = iota
+	levelDebug
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[string]logLevel{
+	"TRACE":   levelTrace,
+	"DEBUG":   levelDebug,
+	"INFO":    levelInfo,
+	"WARN":    levelWarn,
+	"WARNING": levelWarn,
+	"ERROR":   levelError,
+	"SEVERE":  levelError,
+	"FATAL":   levelError,
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	level, ok := logLevelNames[strings.ToUpper(s)]
+	if !ok {
+		return 0, fmt.Errorf("unknown log level '%s', expected trace, debug, info, warn or error", s)
+	}
+	return level, nil
+}
+
+func (l logLevel) String() string {
+	return [...]string{"trace", "debug", "info", "warn", "error"}[l]
+}
+
+// outputFilter selects which server output a remote console session receives.
+// It is updated from the session's input while output is being written, so access is guarded.
+type outputFilter struct {
+	mu       sync.Mutex
+	minLevel logLevel
+	include  *regexp.Regexp
+	exclude  *regexp.Regexp
+	// stream limits output to stdout or stderr when not empty
+	stream string
+	// lastLevel is applied to lines without a level, such as the rest of a stack trace
+	lastLevel logLevel
+}
+
+func newOutputFilter() *outputFilter {
+	return &outputFilter{
+		minLevel:  levelTrace,
+		lastLevel: levelInfo,
+	}
+}
+
+// set changes one filter setting by name, as used by environment variables, the user name
+// suffix and the :filter escape command
+func (f *outputFilter) set(name string, value string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch strings.ToLower(name) {
+	case "level":
+		level, err := parseLogLevel(value)
+		if err != nil {
+			return err
+		}
+		f.minLevel = level
+	case "include", "exclude":
+		var pattern *regexp.Regexp
+		if value != "" {
+			var err error
+			pattern, err = regexp.Compile(value)
+			if err != nil {
+				return fmt.Errorf("invalid %s regex: %w", name, err)
+			}
+		}
+		if strings.ToLower(name) == "include" {
+			f.include = pattern
+		} else {
+			f.exclude = pattern
+		}
+	case "stream":
+		switch strings.ToLower(value) {
+		case "stdout", "stderr":
+			f.stream = strings.ToLower(value)
+		case "", "all":
+			f.stream = ""
+		default:
+			return fmt.Errorf("unknown stream '%s', expected stdout, stderr or all", value)
+		}
+	default:
+		return fmt.Errorf("unknown filter '%s', expected level, include, exclude or stream", name)
+	}
+	return nil
+}
+
+func (f *outputFilter) clear() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.minLevel = levelTrace
+	f.include = nil
+	f.exclude = nil
+	f.stream = ""
+}
+
+func (f *outputFilter) describe() string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	describePattern := func(p *regexp.Regexp) string {
+		if p == nil {
+			return "(none)"
+		}
+		return p.String()
+	}
+	stream := f.stream
+	if stream == "" {
+		stream = "all"
+	}
+	return fmt.Sprintf("level=%s include=%s exclude=%s stream=%s",
+		f.minLevel, describePattern(f.include), describePattern(f.exclude), stream)
+}
+
+func (f *outputFilter) allows(target hub.Target, line []byte) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if m := logLevelPattern.FindSubmatch(line); m != nil {
+		f.lastLevel = logLevelNames[string(m[1])]
+	}
+
+	switch {
+	case f.stream == "stdout" && target != hub.Stdout:
+		return false
+	case f.stream == "stderr" && target != hub.Stderr:
+		return false
+	case f.lastLevel < f.minLevel:
+		return false
+	case f.include != nil && !f.include.Match(line):
+		return false
+	case f.exclude != nil && f.exclude.Match(line):
+		return false
+	}
+	return true
+}
+
+// splitUserFilters separates the filters of a user name such as "alice+level=warn,stream=stdout"
+// from the user name itself
+func splitUserFilters(user string) (string, string) {
+	name, filters, _ := strings.Cut(user, "+")
+	return name, filters
+}
+
+// sessionOutputFilter builds the initial filter of a session from its user name suffix,
+// followed by its environment variables
+func sessionOutputFilter(session ssh.Session) (*outputFilter, error) {
+	filter := newOutputFilter()
+
+	_, userFilters := splitUserFilters(session.User())
+	if userFilters != "" {
+		for _, entry := range strings.Split(userFilters, ",") {
+			name, value, _ := strings.Cut(entry, "=")
+			if err := filter.set(name, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for name, env := range map[string]string{
+		"level":   filterLevelEnv,
+		"include": filterIncludeEnv,
+		"exclude": filterExcludeEnv,
+		"stream":  filterStreamEnv,
+	} {
+		if value, ok := sessionEnv(session, env); ok {
+			if err := filter.set(name, value); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return filter, nil
+}
+
+const escapeCommandHelp = `Session commands:
+  :level <trace|debug|info|warn|error>   only show output at or above the level
+  :filter include <regex>                only show output matching the regex
+  :filter exclude <regex>                hide output matching the regex
+  :filter stream <stdout|stderr|all>     only show one output stream
+  :filter clear                          remove all filters
+  :filter                                show the current filters
+`
+
+// handleEscapeCommand runs a session command, such as ":level warn", and returns the response to show
+func handleEscapeCommand(line string, filter *outputFilter) string {
+	fields := strings.Fields(strings.TrimPrefix(line, escapeCommandPrefix))
+	if len(fields) == 0 {
+		return escapeCommandHelp
+	}
+
+	switch fields[0] {
+	case "level":
+		if len(fields) != 2 {
+			return "Usage: :level <trace|debug|info|warn|error>\n"
+		}
+		if err := filter.set("level", fields[1]); err != nil {
+			return err.Error() + "\n"
+		}
+	case "filter":
+		switch {
+		case len(fields) == 1:
+		case fields[1] == "clear":
+			filter.clear()
+		case len(fields) >= 2:
+			// keep the regex intact, including any spaces it contains
+			_, value, _ := strings.Cut(strings.TrimSpace(strings.TrimPrefix(line, escapeCommandPrefix+"filter")), " ")
+			if err := filter.set(fields[1], strings.TrimSpace(value)); err != nil {
+				return err.Error() + "\n"
+			}
+		}
+	default:
+		return escapeCommandHelp
+	}
+	return "Filters: " + filter.describe() + "\n"
+}
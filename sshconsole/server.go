@@ -0,0 +1,517 @@
+// Package sshconsole serves the server's console over SSH, authenticated by a password or public key.
+// Interactive sessions get a terminal with history and completion, one-shot commands get their output
+// relayed back, and the SFTP subsystem optionally gives access to the server's files.
+package sshconsole
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/google/uuid"
+	"github.com/itzg/mc-server-runner/hub"
+	"github.com/itzg/mc-server-runner/loginlimit"
+	"go.uber.org/zap"
+	gossh "golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+const (
+	RSAKeyType string = "RSA PRIVATE KEY"
+	ECKeyType         = "EC PRIVATE KEY"
+)
+
+// DefaultAddress is where the console listens when Options.Address isn't set
+const DefaultAddress = ":2222"
+
+// Settings are the settings of a Server that may change while it runs
+type Settings struct {
+	// Password authenticates clients. When empty, no client is authenticated by password.
+	Password string
+	// AuthorizedKeys are the public keys that authenticate clients
+	AuthorizedKeys []gossh.PublicKey
+}
+
+// Options configure a Server
+type Options struct {
+	// Address is the host and port to listen on and defaults to DefaultAddress
+	Address string
+	// Prompt is shown to interactive sessions
+	Prompt string
+	// HistoryDir, when set, keeps each user's command history in a file within it
+	HistoryDir  string
+	HistorySize int
+	// ExecTimeout is how long the output of a one-shot command is relayed to the client
+	ExecTimeout time.Duration
+	// SftpRoot enables the SFTP subsystem, limited to this directory, when set
+	SftpRoot string
+	// SftpOwner, when set, owns the files and directories that SFTP clients create, such as the
+	// server's user when it doesn't run as the runner's user
+	SftpOwner *FileOwner
+	// SessionBufferSize and OverflowPolicy bound the output queued for each session
+	SessionBufferSize int
+	OverflowPolicy    hub.OverflowPolicy
+	// Limiter, when set, applies login and session limits to clients
+	Limiter  *loginlimit.Limiter
+	Settings Settings
+	Logger   *zap.Logger
+}
+
+// Server relays console input from its sessions to the server and sends them the server's output
+type Server struct {
+	logger   *zap.Logger
+	opts     Options
+	settings atomic.Pointer[Settings]
+
+	stdInLock sync.Mutex
+	stdInPipe io.Writer
+	output    *hub.Hub
+
+	sessionLock    sync.Mutex
+	remoteSessions map[uuid.UUID]*consoleSession
+
+	players *playerTracker
+}
+
+// New creates a server that writes session input to stdin and sends the output of the hub to its sessions
+func New(output *hub.Hub, stdin io.Writer, opts Options) *Server {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	if opts.Address == "" {
+		opts.Address = DefaultAddress
+	}
+	s := &Server{
+		logger:         opts.Logger,
+		opts:           opts,
+		stdInPipe:      stdin,
+		output:         output,
+		remoteSessions: map[uuid.UUID]*consoleSession{},
+		players:        newPlayerTracker(),
+	}
+	s.settings.Store(&opts.Settings)
+	go s.players.track(output.Subscribe("player tracker", opts.SessionBufferSize, hub.DropOldest))
+	return s
+}
+
+// UpdateSettings applies settings, such as after a configuration reload
+func (s *Server) UpdateSettings(settings Settings) {
+	s.settings.Store(&settings)
+}
+
+// WriteToStdIn safely writes to the server's stdin, alongside the sessions
+func (s *Server) WriteToStdIn(p []byte) (n int, err error) {
+	s.stdInLock.Lock()
+	n, err = s.stdInPipe.Write(p)
+	s.stdInLock.Unlock()
+
+	return n, err
+}
+
+// Register a remote console session for output
+// The session's output is queued and written by its own goroutine, so a slow client can't hold up the others.
+func (s *Server) registerSession(id uuid.UUID, session *consoleSession) {
+	session.queue = s.output.Subscribe("ssh "+id.String(), s.opts.SessionBufferSize, s.opts.OverflowPolicy)
+	session.drained = make(chan struct{})
+	go session.drainOutput(s.output, s.logger)
+
+	s.sessionLock.Lock()
+	s.remoteSessions[id] = session
+	s.sessionLock.Unlock()
+}
+
+// Deregister a remote console session
+func (s *Server) unregisterSession(id uuid.UUID) {
+	s.sessionLock.Lock()
+	session, exists := s.remoteSessions[id]
+	delete(s.remoteSessions, id)
+	s.sessionLock.Unlock()
+
+	if exists {
+		session.queue.Unsubscribe()
+	}
+}
+
+func (s *Server) passwordHandler(ctx ssh.Context, password string) bool {
+	logger, limiter := s.logger, s.opts.Limiter
+	ip := loginlimit.RemoteIP(ctx.RemoteAddr().String())
+	if allowed, retryAfter := limiter.Allow(ip); !allowed {
+		logger.Warn(fmt.Sprintf("Remote console session rejected, client is locked out (%s/%s)", ctx.User(), ctx.RemoteAddr().String()),
+			zap.Duration("retryAfter", retryAfter))
+		return false
+	}
+
+	expectedPassword := s.settings.Load().Password
+	lengthComp := subtle.ConstantTimeEq(int32(len(password)), int32(len(expectedPassword)))
+	contentComp := subtle.ConstantTimeCompare([]byte(password), []byte(expectedPassword))
+	isValid := expectedPassword != "" && lengthComp == 1 && contentComp == 1
+	if !isValid {
+		logger.Warn(fmt.Sprintf("Remote console session rejected (%s/%s)", ctx.User(), ctx.RemoteAddr().String()))
+		limiter.RecordFailure(ip, "ssh")
+	} else {
+		limiter.RecordSuccess(ip)
+	}
+	return isValid
+}
+
+// publicKeyHandler accepts the keys in the current settings. Offered keys that
+// aren't listed don't count as failed logins, since clients commonly try several keys.
+func (s *Server) publicKeyHandler(ctx ssh.Context, key ssh.PublicKey) bool {
+	limiter := s.opts.Limiter
+	ip := loginlimit.RemoteIP(ctx.RemoteAddr().String())
+	if allowed, _ := limiter.Allow(ip); !allowed {
+		return false
+	}
+
+	for _, authorized := range s.settings.Load().AuthorizedKeys {
+		if ssh.KeysEqual(key, authorized) {
+			s.logger.Debug(fmt.Sprintf("Remote console public key accepted (%s/%s)", ctx.User(), ctx.RemoteAddr().String()))
+			limiter.RecordSuccess(ip)
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) handleSession(session ssh.Session) {
+	logger, limiter := s.logger, s.opts.Limiter
+	ip := loginlimit.RemoteIP(session.RemoteAddr().String())
+	if !limiter.AcquireSession(ip) {
+		fmt.Fprintln(session.Stderr(), "Too many concurrent console sessions from your address")
+		session.Exit(1)
+		return
+	}
+	defer limiter.ReleaseSession(ip)
+
+	filter, err := sessionOutputFilter(session)
+	if err != nil {
+		fmt.Fprintf(session.Stderr(), "Invalid output filter: %s\n", err)
+		session.Exit(1)
+		return
+	}
+
+	if session.RawCommand() != "" {
+		s.handleExec(session, filter)
+		return
+	}
+
+	// Setup state for the console session
+	sessionId := uuid.New()
+	pty, winCh, isTty := session.Pty()
+	logger.Info(fmt.Sprintf("Remote console session accepted (%s/%s) isTTY: %t", session.User(), session.RemoteAddr().String(), isTty))
+
+	// Wrap the session in a terminal so we can read lines.
+	// Individual lines will be sent to the input channel to be processed as commands for the server.
+	// If the user sends Ctrl-C/D, this shows up as an EOF and will close the channel.
+	terminal := term.NewTerminal(session, "")
+	cs := &consoleSession{
+		session:  session,
+		terminal: terminal,
+		isTty:    isTty,
+		filter:   filter,
+	}
+	if isTty {
+		userName, _ := splitUserFilters(session.User())
+		terminal.SetPrompt(s.opts.Prompt)
+		terminal.SetSize(pty.Window.Width, pty.Window.Height)
+		terminal.History = newFileHistory(s.opts.HistoryDir, userName, s.opts.HistorySize, logger)
+		terminal.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+			return completeLine(line, pos, key, s.players)
+		}
+		go cs.watchWindow(winCh)
+	}
+	s.registerSession(sessionId, cs)
+
+	input := make(chan string)
+	go func() {
+		for {
+			line, err := terminal.ReadLine()
+			if err != nil {
+				// Check for client-triggered (expected) exit before logging as an error.
+				if err != io.EOF {
+					logger.Error(fmt.Sprintf("Unable to read line from session (%s/%s)", session.User(), session.RemoteAddr().String()), zap.Error(err))
+				}
+				close(input)
+				return
+			}
+
+			input <- line
+		}
+	}()
+
+InputLoop:
+	for {
+		select {
+		case line, ok := <-input:
+			if !ok {
+				break InputLoop
+			}
+
+			if strings.HasPrefix(line, escapeCommandPrefix) {
+				terminal.Write([]byte(handleEscapeCommand(line, filter)))
+				continue
+			}
+
+			lineBytes := []byte(fmt.Sprintf("%s\n", line))
+			_, err := s.WriteToStdIn(lineBytes)
+			if err != nil {
+				logger.Error(fmt.Sprintf("Session failed to write to stdin (%s/%s)", session.User(), session.RemoteAddr().String()), zap.Error(err))
+			}
+		case <-session.Context().Done():
+			break InputLoop
+		}
+	}
+
+	// Tear down the session
+	s.unregisterSession(sessionId)
+	logger.Info(fmt.Sprintf("Remote console session disconnected (%s/%s)", session.User(), session.RemoteAddr().String()))
+}
+
+const (
+	// Current filename, hides on Linux systems.
+	HostKeyFilename string = ".hostKey.pem"
+
+	// Old filename, not hidden.
+	OldHostKeyFilename = "hostKey.pem"
+)
+
+// Use the hidden form first, but fallback to the non-hidden one if it already exists.
+func pickHostKeyPath(homeDir string) string {
+	defaultKeyfilePath := filepath.Join(homeDir, HostKeyFilename)
+	_, err := os.Stat(defaultKeyfilePath)
+	if !os.IsNotExist(err) {
+		return defaultKeyfilePath
+	}
+
+	fallbackKeyfilePath := filepath.Join(homeDir, OldHostKeyFilename)
+	_, err = os.Stat(fallbackKeyfilePath)
+	if !os.IsNotExist(err) {
+		return fallbackKeyfilePath
+	}
+
+	return defaultKeyfilePath
+}
+
+// Exists to clean up the non-hidden key file if it still exists
+func cleanupOldHostKey() error {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+
+	keyfilePath := filepath.Join(homeDir, OldHostKeyFilename)
+	_, err = os.Stat(keyfilePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	err = os.Remove(keyfilePath)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(keyfilePath)
+	if !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+type hostKeys struct {
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+}
+
+func populateKeys(keys *hostKeys, logger *zap.Logger) (bool, error) {
+	didAdd := false
+	if keys.ecKey == nil {
+		logger.Info("Generating ECDSA SSH Host Key")
+		ellipticKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		if err != nil {
+			return didAdd, err
+		}
+
+		keys.ecKey = ellipticKey
+		didAdd = true
+	}
+
+	if keys.rsaKey == nil {
+		logger.Info("Generating RSA SSH Host Key")
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 4096)
+		if err != nil {
+			return didAdd, err
+		}
+
+		keys.rsaKey = rsaKey
+		didAdd = true
+	}
+
+	return didAdd, nil
+}
+
+func writeKeys(hostKeyPath string, keys *hostKeys, logger *zap.Logger) error {
+	keysFile, err := os.OpenFile(hostKeyPath, os.O_CREATE+os.O_WRONLY+os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	defer keysFile.Close()
+
+	logger.Info(fmt.Sprintf("Writing Host Keys to %s.", hostKeyPath))
+	if keys.ecKey != nil {
+		ecDER, err := x509.MarshalECPrivateKey(keys.ecKey)
+		if err != nil {
+			return err
+		}
+
+		ecBlock := pem.Block{
+			Type:  ECKeyType,
+			Bytes: ecDER,
+		}
+
+		pem.Encode(keysFile, &ecBlock)
+	}
+
+	if keys.rsaKey != nil {
+		rsaDER := x509.MarshalPKCS1PrivateKey(keys.rsaKey)
+		rsaBlock := pem.Block{
+			Type:  RSAKeyType,
+			Bytes: rsaDER,
+		}
+
+		pem.Encode(keysFile, &rsaBlock)
+	}
+
+	return nil
+}
+
+func readKeys(hostKeyPath string) (*hostKeys, error) {
+	bytes, err := os.ReadFile(hostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys hostKeys
+	for len(bytes) > 0 {
+		pemBlock, next := pem.Decode(bytes)
+		if pemBlock == nil {
+			break
+		}
+
+		switch pemBlock.Type {
+		case RSAKeyType:
+			rsaKey, err := x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+			if err != nil {
+				return &keys, err
+			}
+			keys.rsaKey = rsaKey
+		case ECKeyType:
+			ecKey, err := x509.ParseECPrivateKey(pemBlock.Bytes)
+			if err != nil {
+				return &keys, err
+			}
+			keys.ecKey = ecKey
+		}
+
+		bytes = next
+	}
+
+	return &keys, nil
+}
+
+func ensureHostKeys(logger *zap.Logger) (*hostKeys, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+
+	keyfilePath := pickHostKeyPath(homeDir)
+	defaultKeyfilePath := filepath.Join(homeDir, HostKeyFilename)
+	fileChanged := keyfilePath != defaultKeyfilePath
+	_, err = os.Stat(keyfilePath)
+	if os.IsNotExist(err) {
+		logger.Info("Generating host keys for remote shell server.")
+		var hostKeys hostKeys
+		addedKeys, err := populateKeys(&hostKeys, logger)
+
+		if (fileChanged || addedKeys) && err == nil {
+			writeKeys(defaultKeyfilePath, &hostKeys, logger)
+		}
+		return &hostKeys, err
+	} else {
+		logger.Info(fmt.Sprintf("Reading host keys for remote shell from %s.", keyfilePath))
+		hostKeys, err := readKeys(keyfilePath)
+		if err != nil {
+			return nil, err
+		}
+
+		// Populate missing keys (older files only have RSA)
+		addedKeys, err := populateKeys(hostKeys, logger)
+
+		if (fileChanged || addedKeys) && err == nil {
+			writeKeys(defaultKeyfilePath, hostKeys, logger)
+		}
+		return hostKeys, err
+	}
+}
+
+func twinKeys(keys *hostKeys) ssh.Option {
+	return func(srv *ssh.Server) error {
+		rsaSigner, err := gossh.NewSignerFromKey(keys.rsaKey)
+		if err != nil {
+			return err
+		}
+		srv.AddHostKey(rsaSigner)
+
+		ecSigner, err := gossh.NewSignerFromKey(keys.ecKey)
+		if err != nil {
+			return err
+		}
+		srv.AddHostKey(ecSigner)
+
+		return nil
+	}
+}
+
+// ListenAndServe serves the console until it fails, which includes when the address
+// can't be listened on
+func (s *Server) ListenAndServe() error {
+	logger := s.logger
+	logger.Info("Starting remote shell server on " + s.opts.Address + "...")
+
+	hostKeys, err := ensureHostKeys(logger)
+	if err != nil {
+		return fmt.Errorf("unable to ensure host keys exist: %w", err)
+	}
+
+	err = cleanupOldHostKey()
+	if err != nil {
+		logger.Warn("Unable to remote old host key file", zap.Error(err))
+	}
+
+	options := []ssh.Option{
+		twinKeys(hostKeys),
+		ssh.PasswordAuth(s.passwordHandler),
+		ssh.PublicKeyAuth(s.publicKeyHandler),
+	}
+	if s.opts.SftpRoot != "" {
+		logger.Info("Enabling SFTP subsystem", zap.String("root", s.opts.SftpRoot))
+		options = append(options, sftpSubsystem(s.opts.SftpRoot, s.opts.SftpOwner, s.opts.Limiter, logger))
+	}
+
+	return ssh.ListenAndServe(s.opts.Address, s.handleSession, options...)
+}
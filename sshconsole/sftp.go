@@ -0,0 +1,290 @@
+package sshconsole
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/itzg/mc-server-runner/loginlimit"
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+)
+
+// rootedFS serves SFTP requests from a directory opened with os.OpenRoot, so that no
+// request, including through symlinks, can reach files outside that directory.
+type rootedFS struct {
+	root *os.Root
+	// owner, when set, is given the files and directories that clients create
+	owner *FileOwner
+}
+
+// FileOwner is the user and group that own the files created over SFTP
+type FileOwner struct {
+	UID int
+	GID int
+}
+
+// chown gives a newly created file, directory or link to the owner
+func (fs *rootedFS) chown(name string) error {
+	if fs.owner == nil {
+		return nil
+	}
+	return fs.root.Lchown(name, fs.owner.UID, fs.owner.GID)
+}
+
+// relPath converts the absolute path of a request into one relative to the root
+func relPath(requestPath string) string {
+	cleaned := path.Clean("/" + requestPath)
+	if cleaned == "/" {
+		return "."
+	}
+	return cleaned[1:]
+}
+
+func (fs *rootedFS) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	return fs.root.Open(relPath(r.Filepath))
+}
+
+func (fs *rootedFS) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	return fs.openFile(r)
+}
+
+// OpenFile supports clients that open a file for both reading and writing
+func (fs *rootedFS) OpenFile(r *sftp.Request) (sftp.WriterAtReaderAt, error) {
+	return fs.openFile(r)
+}
+
+func (fs *rootedFS) openFile(r *sftp.Request) (*os.File, error) {
+	pflags := r.Pflags()
+	var flags int
+	switch {
+	case pflags.Read && pflags.Write:
+		flags = os.O_RDWR
+	case pflags.Write:
+		flags = os.O_WRONLY
+	default:
+		flags = os.O_RDONLY
+	}
+	if pflags.Append {
+		flags |= os.O_APPEND
+	}
+	if pflags.Creat {
+		flags |= os.O_CREATE
+	}
+	if pflags.Trunc {
+		flags |= os.O_TRUNC
+	}
+	if pflags.Excl {
+		flags |= os.O_EXCL
+	}
+
+	name := relPath(r.Filepath)
+	created := false
+	if pflags.Creat && fs.owner != nil {
+		_, err := fs.root.Lstat(name)
+		created = errors.Is(err, os.ErrNotExist)
+	}
+	f, err := fs.root.OpenFile(name, flags, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if created {
+		if err := f.Chown(fs.owner.UID, fs.owner.GID); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (fs *rootedFS) Filecmd(r *sftp.Request) error {
+	target := relPath(r.Filepath)
+
+	switch r.Method {
+	case "Setstat":
+		return fs.setstat(target, r)
+	case "Rename":
+		return fs.root.Rename(target, relPath(r.Target))
+	case "Rmdir", "Remove":
+		return fs.root.Remove(target)
+	case "Mkdir":
+		if err := fs.root.Mkdir(target, 0755); err != nil {
+			return err
+		}
+		return fs.chown(target)
+	case "Link":
+		return fs.root.Link(target, relPath(r.Target))
+	case "Symlink":
+		// Filepath is the link's target and Target is the new link
+		link := relPath(r.Target)
+		linkTarget, err := symlinkTarget(r.Filepath, link)
+		if err != nil {
+			return err
+		}
+		if err := fs.root.Symlink(linkTarget, link); err != nil {
+			return err
+		}
+		return fs.chown(link)
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// symlinkTarget converts the target of a new link into one relative to the link, since the server
+// and other processes follow the link without being limited to the root. An absolute target is
+// within the root as the client sees it, and a target that leads outside of the root is rejected.
+func symlinkTarget(target string, link string) (string, error) {
+	linkDir := path.Dir(link)
+	var resolved string
+	if path.IsAbs(target) {
+		resolved = relPath(target)
+	} else {
+		resolved = path.Join(linkDir, target)
+		if resolved == ".." || strings.HasPrefix(resolved, "../") {
+			return "", os.ErrPermission
+		}
+	}
+	relative, err := filepath.Rel(linkDir, resolved)
+	if err != nil {
+		return "", err
+	}
+	return filepath.ToSlash(relative), nil
+}
+
+func (fs *rootedFS) PosixRename(r *sftp.Request) error {
+	return fs.root.Rename(relPath(r.Filepath), relPath(r.Target))
+}
+
+func (fs *rootedFS) setstat(target string, r *sftp.Request) error {
+	attrs := r.Attributes()
+	attrFlags := r.AttrFlags()
+
+	if attrFlags.Size {
+		f, err := fs.root.OpenFile(target, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		err = f.Truncate(int64(attrs.Size))
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	if attrFlags.Permissions {
+		if err := fs.root.Chmod(target, attrs.FileMode().Perm()); err != nil {
+			return err
+		}
+	}
+	if attrFlags.Acmodtime {
+		if err := fs.root.Chtimes(target, time.Unix(int64(attrs.Atime), 0), time.Unix(int64(attrs.Mtime), 0)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type fileInfoLister []os.FileInfo
+
+func (l fileInfoLister) ListAt(entries []os.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+	n := copy(entries, l[offset:])
+	if n < len(entries) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (fs *rootedFS) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	target := relPath(r.Filepath)
+
+	switch r.Method {
+	case "List":
+		dir, err := fs.root.Open(target)
+		if err != nil {
+			return nil, err
+		}
+		defer dir.Close()
+
+		entries, err := dir.Readdir(-1)
+		if err != nil {
+			return nil, err
+		}
+		return fileInfoLister(entries), nil
+	case "Stat":
+		fi, err := fs.root.Stat(target)
+		if err != nil {
+			return nil, err
+		}
+		return fileInfoLister{fi}, nil
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+func (fs *rootedFS) Lstat(r *sftp.Request) (sftp.ListerAt, error) {
+	fi, err := fs.root.Lstat(relPath(r.Filepath))
+	if err != nil {
+		return nil, err
+	}
+	return fileInfoLister{fi}, nil
+}
+
+func (fs *rootedFS) Readlink(requestPath string) (string, error) {
+	return fs.root.Readlink(relPath(requestPath))
+}
+
+// sftpSubsystem registers an SFTP subsystem on the remote console server that is limited to
+// the given directory. Clients authenticate the same way as for the console itself.
+func sftpSubsystem(rootDir string, owner *FileOwner, limiter *loginlimit.Limiter, logger *zap.Logger) ssh.Option {
+	return func(srv *ssh.Server) error {
+		if srv.SubsystemHandlers == nil {
+			srv.SubsystemHandlers = map[string]ssh.SubsystemHandler{}
+		}
+		srv.SubsystemHandlers["sftp"] = func(session ssh.Session) {
+			ip := loginlimit.RemoteIP(session.RemoteAddr().String())
+			if !limiter.AcquireSession(ip) {
+				session.Exit(1)
+				return
+			}
+			defer limiter.ReleaseSession(ip)
+
+			handleSftpSession(session, rootDir, owner, logger)
+		}
+		return nil
+	}
+}
+
+func handleSftpSession(session ssh.Session, rootDir string, owner *FileOwner, logger *zap.Logger) {
+	root, err := os.OpenRoot(rootDir)
+	if err != nil {
+		logger.Error("Unable to open SFTP root directory", zap.String("dir", rootDir), zap.Error(err))
+		session.Exit(1)
+		return
+	}
+	defer root.Close()
+
+	logger.Info(fmt.Sprintf("SFTP session accepted (%s/%s)", session.User(), session.RemoteAddr().String()))
+
+	fs := &rootedFS{root: root, owner: owner}
+	server := sftp.NewRequestServer(session, sftp.Handlers{
+		FileGet:  fs,
+		FilePut:  fs,
+		FileCmd:  fs,
+		FileList: fs,
+	})
+	err = server.Serve()
+	server.Close()
+	if err != nil && !errors.Is(err, io.EOF) {
+		logger.Error(fmt.Sprintf("SFTP session failed (%s/%s)", session.User(), session.RemoteAddr().String()), zap.Error(err))
+	}
+
+	logger.Info(fmt.Sprintf("SFTP session disconnected (%s/%s)", session.User(), session.RemoteAddr().String()))
+}
@@ -0,0 +1,55 @@
+package sshconsole
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func TestSftpCreatedFilesBelongToOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner of files requires root")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "existing"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	fs := &rootedFS{root: root, owner: &FileOwner{UID: 1000, GID: 1000}}
+
+	for _, name := range []string{"/created", "/existing"} {
+		r := sftp.NewRequest("Put", name)
+		r.Flags = 0x2 | 0x8 // write and create
+		f, err := fs.Filewrite(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.(*os.File).Close()
+	}
+	if err := fs.Filecmd(sftp.NewRequest("Mkdir", "/dir")); err != nil {
+		t.Fatal(err)
+	}
+	symlink := sftp.NewRequest("Symlink", "/created")
+	symlink.Target = "/link"
+	if err := fs.Filecmd(symlink); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]uint32{"created": 1000, "dir": 1000, "link": 1000, "existing": 0} {
+		fi, err := os.Lstat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stat := fi.Sys().(*syscall.Stat_t)
+		if stat.Uid != expected || stat.Gid != expected {
+			t.Errorf("expected %s to be owned by %d, got %d:%d", name, expected, stat.Uid, stat.Gid)
+		}
+	}
+}
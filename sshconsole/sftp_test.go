@@ -0,0 +1,76 @@
+package sshconsole
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+func TestSymlinkTarget(t *testing.T) {
+	tests := []struct {
+		target   string
+		link     string
+		expected string
+		rejected bool
+	}{
+		{"server.properties", "link", "server.properties", false},
+		{"../world/level.dat", "backups/link", "../world/level.dat", false},
+		{"/world/level.dat", "link", "world/level.dat", false},
+		{"/world/level.dat", "backups/old/link", "../../world/level.dat", false},
+		{"/", "backups/link", "..", false},
+		{"/../../etc/passwd", "link", "etc/passwd", false},
+		{"../etc/passwd", "link", "", true},
+		{"../../etc/passwd", "backups/link", "", true},
+		{"world/../../etc", "link", "", true},
+	}
+	for _, tt := range tests {
+		got, err := symlinkTarget(tt.target, tt.link)
+		if tt.rejected {
+			if !errors.Is(err, os.ErrPermission) {
+				t.Errorf("symlinkTarget(%q, %q) = %q, %v, want rejected", tt.target, tt.link, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.expected {
+			t.Errorf("symlinkTarget(%q, %q) = %q, %v, want %q", tt.target, tt.link, got, err, tt.expected)
+		}
+	}
+}
+
+func TestSftpSymlinkStaysWithinRoot(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "data"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	root, err := os.OpenRoot(filepath.Join(dir, "data"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer root.Close()
+	fs := &rootedFS{root: root}
+
+	symlink := func(target string, link string) error {
+		r := sftp.NewRequest("Symlink", "")
+		r.Filepath = target
+		r.Target = link
+		return fs.Filecmd(r)
+	}
+
+	if err := symlink("/etc/passwd", "/absolute"); err != nil {
+		t.Fatal(err)
+	}
+	// the link must resolve within the root for processes that aren't limited to it
+	if resolved, err := os.Readlink(filepath.Join(dir, "data", "absolute")); err != nil || resolved != "etc/passwd" {
+		t.Errorf("expected the absolute target to be stored relative to the root, got %q, %v", resolved, err)
+	}
+
+	if err := symlink("../outside", "/escape"); !errors.Is(err, os.ErrPermission) {
+		t.Errorf("expected a target outside of the root to be rejected, got %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "data", "escape")); !os.IsNotExist(err) {
+		t.Errorf("expected no link to be created, got %v", err)
+	}
+}
@@ -0,0 +1,317 @@
+package sshconsole
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gliderlabs/ssh"
+	"github.com/itzg/mc-server-runner/hub"
+	"go.uber.org/zap"
+	"golang.org/x/term"
+)
+
+// knownCommands are the vanilla server commands offered by tab-completion
+var knownCommands = []string{
+	"advancement", "attribute", "ban", "ban-ip", "banlist", "bossbar", "clear", "clone", "damage",
+	"data", "datapack", "debug", "defaultgamemode", "deop", "difficulty", "effect", "enchant",
+	"execute", "experience", "fill", "fillbiome", "forceload", "function", "gamemode", "gamerule",
+	"give", "help", "item", "jfr", "kick", "kill", "list", "locate", "loot", "me", "msg", "op",
+	"pardon", "pardon-ip", "particle", "perf", "place", "playsound", "publish", "random", "recipe",
+	"reload", "return", "ride", "save-all", "save-off", "save-on", "say", "schedule", "scoreboard",
+	"seed", "setblock", "setidletimeout", "setworldspawn", "spawnpoint", "spectate", "spreadplayers",
+	"stop", "stopsound", "summon", "tag", "team", "teammsg", "teleport", "tell", "tellraw", "tick",
+	"time", "title", "tm", "tp", "transfer", "trigger", "w", "weather", "whitelist", "worldborder", "xp",
+}
+
+var (
+	playerJoinedPattern = regexp.MustCompile(`: (\w{3,16}) joined the game`)
+	playerLeftPattern   = regexp.MustCompile(`: (\w{3,16}) left the game`)
+	logLevelPattern     = regexp.MustCompile(`[/ ](TRACE|DEBUG|INFO|WARN|WARNING|ERROR|SEVERE|FATAL)\]`)
+)
+
+// playerTracker learns the names of online players from the join/leave lines in the server log
+type playerTracker struct {
+	mu      sync.RWMutex
+	players map[string]struct{}
+}
+
+func newPlayerTracker() *playerTracker {
+	return &playerTracker{
+		players: map[string]struct{}{},
+	}
+}
+
+func (pt *playerTracker) observe(line string) {
+	if m := playerJoinedPattern.FindStringSubmatch(line); m != nil {
+		pt.mu.Lock()
+		pt.players[m[1]] = struct{}{}
+		pt.mu.Unlock()
+	} else if m := playerLeftPattern.FindStringSubmatch(line); m != nil {
+		pt.mu.Lock()
+		delete(pt.players, m[1])
+		pt.mu.Unlock()
+	}
+}
+
+// track observes the output of the given subscription until it ends
+func (pt *playerTracker) track(sub *hub.Subscription) {
+	for {
+		chunk, ok := sub.Pop()
+		if !ok {
+			return
+		}
+		pt.observe(string(chunk.Data))
+	}
+}
+
+func (pt *playerTracker) online() []string {
+	pt.mu.RLock()
+	defer pt.mu.RUnlock()
+
+	names := make([]string, 0, len(pt.players))
+	for name := range pt.players {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// completeLine is used as a terminal's AutoCompleteCallback. On tab, the word before the cursor
+// is completed from the known commands, when it's the first word, or from the online players.
+// When there are several candidates, the line is extended to their longest common prefix.
+func completeLine(line string, pos int, key rune, players *playerTracker) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+
+	wordStart := strings.LastIndex(line[:pos], " ") + 1
+	word := line[wordStart:pos]
+
+	var candidates []string
+	if strings.TrimSpace(line[:wordStart]) == "" {
+		prefix := ""
+		if strings.HasPrefix(word, "/") {
+			prefix = "/"
+		}
+		for _, cmd := range knownCommands {
+			if strings.HasPrefix(prefix+cmd, word) {
+				candidates = append(candidates, prefix+cmd)
+			}
+		}
+	} else {
+		for _, name := range players.online() {
+			if strings.HasPrefix(strings.ToLower(name), strings.ToLower(word)) {
+				candidates = append(candidates, name)
+			}
+		}
+	}
+
+	var completion string
+	switch len(candidates) {
+	case 0:
+		return line, pos, true
+	case 1:
+		completion = candidates[0] + " "
+	default:
+		completion = commonPrefix(candidates)
+		if len(completion) < len(word) {
+			return line, pos, true
+		}
+	}
+
+	newLine := line[:wordStart] + completion + line[pos:]
+	return newLine, wordStart + len(completion), true
+}
+
+func commonPrefix(values []string) string {
+	prefix := values[0]
+	for _, v := range values[1:] {
+		for !strings.HasPrefix(v, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// colorizeLogLine wraps a line of server output in the color of its log level
+func colorizeLogLine(line []byte, escape *term.EscapeCodes) []byte {
+	m := logLevelPattern.FindSubmatch(line)
+	if m == nil {
+		return line
+	}
+
+	var color []byte
+	switch string(m[1]) {
+	case "WARN", "WARNING":
+		color = escape.Yellow
+	case "ERROR", "SEVERE", "FATAL":
+		color = escape.Red
+	case "DEBUG", "TRACE":
+		color = escape.Cyan
+	default:
+		return line
+	}
+
+	content := strings.TrimRight(string(line), "\r\n")
+	colored := slices.Concat(color, []byte(content), escape.Reset, line[len(content):])
+	return colored
+}
+
+// fileHistory is a term.History that persists a bounded list of entered commands to a file
+type fileHistory struct {
+	logger  *zap.Logger
+	path    string
+	limit   int
+	mu      sync.Mutex
+	entries []string
+}
+
+var historyUserSanitizer = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+func newFileHistory(dir string, user string, limit int, logger *zap.Logger) *fileHistory {
+	if limit < 0 {
+		limit = 0
+	}
+	h := &fileHistory{
+		logger: logger,
+		limit:  limit,
+	}
+	if dir == "" {
+		return h
+	}
+
+	h.path = filepath.Join(dir, historyUserSanitizer.ReplaceAllString(user, "_"))
+	f, err := os.Open(h.path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logger.Warn("Unable to read console history", zap.String("path", h.path), zap.Error(err))
+		}
+		return h
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := scanner.Text(); line != "" {
+			h.entries = append(h.entries, line)
+		}
+	}
+	if len(h.entries) > limit {
+		h.entries = h.entries[len(h.entries)-limit:]
+	}
+	return h
+}
+
+func (h *fileHistory) Add(entry string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if entry == "" || (len(h.entries) > 0 && h.entries[len(h.entries)-1] == entry) {
+		return
+	}
+	h.entries = append(h.entries, entry)
+	if len(h.entries) > h.limit {
+		h.entries = h.entries[len(h.entries)-h.limit:]
+	}
+	h.save()
+}
+
+func (h *fileHistory) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.entries)
+}
+
+func (h *fileHistory) At(idx int) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.entries[len(h.entries)-1-idx]
+}
+
+func (h *fileHistory) save() {
+	if h.path == "" {
+		return
+	}
+
+	err := os.MkdirAll(filepath.Dir(h.path), 0700)
+	if err == nil {
+		content := strings.Join(h.entries, "\n") + "\n"
+		err = os.WriteFile(h.path, []byte(content), 0600)
+	}
+	if err != nil {
+		h.logger.Warn("Unable to save console history", zap.String("path", h.path), zap.Error(err))
+	}
+}
+
+// consoleSession is a remote console session along with the terminal that manages its input line
+type consoleSession struct {
+	session  ssh.Session
+	terminal *term.Terminal
+	isTty    bool
+	filter   *outputFilter
+	// matcher, when set, watches the output of an exec session for its expected response
+	matcher *outputMatcher
+	// queue holds output not yet written to the session, drained is closed once it has been written
+	queue   *hub.Subscription
+	drained chan struct{}
+}
+
+// drainOutput writes queued output to the session until the session is unregistered. A session
+// that overflows a queue with the disconnect policy is closed.
+func (cs *consoleSession) drainOutput(output *hub.Hub, logger *zap.Logger) {
+	defer close(cs.drained)
+
+	for {
+		chunk, ok := cs.queue.Pop()
+		if !ok {
+			break
+		}
+		cs.writeOutput(chunk.Target, chunk.Data)
+	}
+
+	if cs.queue.Overflowed() {
+		logger.Warn(fmt.Sprintf("Remote console session disconnected, too far behind on output (%s/%s)", cs.session.User(), cs.session.RemoteAddr().String()),
+			zap.Uint64("totalDroppedBytes", output.DroppedBytes()))
+		cs.session.Close()
+	} else if dropped := cs.queue.Dropped(); dropped > 0 {
+		logger.Warn(fmt.Sprintf("Remote console session fell behind and missed output (%s/%s)", cs.session.User(), cs.session.RemoteAddr().String()),
+			zap.Uint64("droppedBytes", dropped),
+			zap.Uint64("totalDroppedBytes", output.DroppedBytes()))
+	}
+}
+
+// writeOutput sends server output to the session. On a TTY the output goes through the terminal
+// so that the prompt and any partially typed command are redrawn below it.
+func (cs *consoleSession) writeOutput(target hub.Target, p []byte) {
+	if cs.matcher != nil {
+		cs.matcher.observe(p)
+	}
+	if !cs.filter.allows(target, p) {
+		return
+	}
+	if cs.isTty {
+		cs.terminal.Write(colorizeLogLine(p, cs.terminal.Escape))
+		return
+	}
+
+	switch target {
+	case hub.Stdout:
+		cs.session.Write(p)
+	case hub.Stderr:
+		cs.session.Stderr().Write(p)
+	}
+}
+
+// watchWindow keeps the terminal size in sync with the client's window
+func (cs *consoleSession) watchWindow(winCh <-chan ssh.Window) {
+	for win := range winCh {
+		cs.terminal.SetSize(win.Width, win.Height)
+	}
+}
@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func startServer(cmd *exec.Cmd, privileges *serverPrivileges) error {
+	if privileges.switchUser || privileges.noNewPrivs || privileges.umask >= 0 ||
+		privileges.rlimitNofile != nil || privileges.rlimitCore != nil {
+		return errors.New("the server-* user and limit settings are only supported on linux")
+	}
+	return cmd.Start()
+}
+
+func execServerIfWrapper() {
+	// the runner is only started as a wrapper on linux
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// serverExecEnv is set when the runner is started as the wrapper that applies the settings in
+// its value and then execs the server
+const serverExecEnv = "MC_SERVER_RUNNER_EXEC"
+
+// startServer starts the server with its privileges. The umask, resource limits and no-new-privs
+// can't be given to exec.Cmd, and applying them to the runner meanwhile couldn't always be undone,
+// so the runner starts itself as a wrapper that applies them and then execs the server. The wrapper
+// starts with the runner's privileges, so that it may raise limits beyond the inherited hard limits,
+// and switches to the server's user itself right before the exec.
+func startServer(cmd *exec.Cmd, privileges *serverPrivileges) error {
+	env := cmd.Environ()
+	if privileges.switchUser && privileges.home != "" {
+		env = append(env, "HOME="+privileges.home)
+	}
+
+	if settings := privileges.execSettings(); settings != "" {
+		self, err := os.Executable()
+		if err != nil {
+			return fmt.Errorf("unable to locate the runner executable: %w", err)
+		}
+		if privileges.switchUser {
+			settings += "," + privileges.userSettings()
+		}
+		env = append(env, serverExecEnv+"="+settings)
+		cmd.Args = append([]string{self, cmd.Path}, cmd.Args...)
+		cmd.Path = self
+	} else if privileges.switchUser {
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Credential = &syscall.Credential{
+			Uid:    privileges.uid,
+			Gid:    privileges.gid,
+			Groups: privileges.groups,
+		}
+	}
+	cmd.Env = env
+
+	return cmd.Start()
+}
+
+// execSettings encodes the settings applied by the wrapper, such as "umask=27,nofile=4096:8192,no-new-privs",
+// and is empty when there are none
+func (p *serverPrivileges) execSettings() string {
+	var settings []string
+	if p.umask >= 0 {
+		settings = append(settings, "umask="+strconv.FormatInt(int64(p.umask), 8))
+	}
+	for _, limit := range []struct {
+		name  string
+		value *serverRlimit
+	}{
+		{"nofile", p.rlimitNofile},
+		{"core", p.rlimitCore},
+	} {
+		if limit.value != nil {
+			settings = append(settings, fmt.Sprintf("%s=%d:%d", limit.name, limit.value.soft, limit.value.hard))
+		}
+	}
+	if p.noNewPrivs {
+		settings = append(settings, "no-new-privs")
+	}
+	return strings.Join(settings, ",")
+}
+
+// userSettings encodes the user the wrapper switches to, such as "uid=1000,gid=1000,groups=1000:27"
+func (p *serverPrivileges) userSettings() string {
+	groups := make([]string, len(p.groups))
+	for i, gid := range p.groups {
+		groups[i] = strconv.FormatUint(uint64(gid), 10)
+	}
+	return fmt.Sprintf("uid=%d,gid=%d,groups=%s", p.uid, p.gid, strings.Join(groups, ":"))
+}
+
+// execServerIfWrapper applies the settings and execs the server when the runner was started by
+// startServer as a wrapper, and otherwise returns
+func execServerIfWrapper() {
+	settings, ok := os.LookupEnv(serverExecEnv)
+	if !ok {
+		return
+	}
+	os.Unsetenv(serverExecEnv)
+	if len(os.Args) < 3 {
+		log.Fatal("missing server command")
+	}
+
+	// no-new-privs only applies to the thread that sets it, which needs to be the one that execs
+	runtime.LockOSThread()
+	var uid, gid *int
+	var groups []int
+	for _, setting := range strings.Split(settings, ",") {
+		name, value, _ := strings.Cut(setting, "=")
+		var err error
+		switch name {
+		case "umask":
+			var umask uint64
+			umask, err = strconv.ParseUint(value, 8, 32)
+			if err == nil {
+				syscall.Umask(int(umask))
+			}
+		case "nofile":
+			err = setRlimit(syscall.RLIMIT_NOFILE, value)
+		case "core":
+			err = setRlimit(syscall.RLIMIT_CORE, value)
+		case "no-new-privs":
+			err = unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0)
+		case "uid":
+			uid, err = parseId(value)
+		case "gid":
+			gid, err = parseId(value)
+		case "groups":
+			groups, err = parseIds(value)
+		default:
+			err = fmt.Errorf("unknown setting")
+		}
+		if err != nil {
+			log.Fatalf("unable to apply %s to the server: %s", setting, err)
+		}
+	}
+
+	// the user is switched last, since the settings above may need the runner's privileges
+	if uid != nil && gid != nil {
+		if err := syscall.Setgroups(groups); err != nil {
+			log.Fatalf("unable to set the supplementary groups of the server: %s", err)
+		}
+		if err := syscall.Setgid(*gid); err != nil {
+			log.Fatalf("unable to set the group of the server: %s", err)
+		}
+		if err := syscall.Setuid(*uid); err != nil {
+			log.Fatalf("unable to set the user of the server: %s", err)
+		}
+	}
+
+	err := syscall.Exec(os.Args[1], os.Args[2:], os.Environ())
+	log.Fatalf("unable to start %s: %s", os.Args[1], err)
+}
+
+func setRlimit(resource int, value string) error {
+	limit, err := parseRlimit(value)
+	if err != nil {
+		return err
+	}
+	// syscall.Setrlimit, unlike unix.Setrlimit, also stops the exec from restoring the
+	// RLIMIT_NOFILE that the Go runtime started with
+	return syscall.Setrlimit(resource, &syscall.Rlimit{Cur: limit.soft, Max: limit.hard})
+}
+
+func parseId(value string) (*int, error) {
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	result := int(id)
+	return &result, nil
+}
+
+func parseIds(value string) ([]int, error) {
+	ids := []int{}
+	if value == "" {
+		return ids, nil
+	}
+	for _, entry := range strings.Split(value, ":") {
+		id, err := parseId(entry)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, *id)
+	}
+	return ids, nil
+}
@@ -0,0 +1,26 @@
+package supervisor
+
+import "time"
+
+// Clock is what the supervisor waits on while stopping the server, so that callers can control
+// the time that passes, such as in tests
+type Clock interface {
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type Timer interface {
+	// Stop prevents the timer from firing and reports whether it did
+	Stop() bool
+}
+
+// RealClock is the system's clock
+type RealClock struct{}
+
+func (RealClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (RealClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
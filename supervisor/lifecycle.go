@@ -0,0 +1,151 @@
+package supervisor
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// State is a stage in the life of the server process
+type State string
+
+const (
+	// Starting is until the server process has been started
+	Starting State = "starting"
+	// Running is once the server process is running, but not known to be ready for commands
+	Running State = "running"
+	// Ready is once the server is ready for commands
+	Ready State = "ready"
+	// StoppingAnnounced is while waiting out the stop server announce delay
+	StoppingAnnounced State = "stopping-announced"
+	// Stopping is once the stop command has been sent
+	Stopping State = "stopping"
+	// Killing is once the server didn't stop in time and is being killed
+	Killing State = "killing"
+	// Exited is once the server process has exited
+	Exited State = "exited"
+	// Restarting is once the watchdog stops an unresponsive server so it can be restarted
+	Restarting State = "restarting"
+)
+
+// stateTransitions lists the states each state may change to. Other changes are ignored,
+// such as the server logging that it's ready after it was told to stop.
+var stateTransitions = map[State][]State{
+	Starting:          {Running, StoppingAnnounced, Stopping, Killing, Exited},
+	Running:           {Ready, StoppingAnnounced, Stopping, Killing, Exited, Restarting},
+	Ready:             {StoppingAnnounced, Stopping, Killing, Exited, Restarting},
+	StoppingAnnounced: {Stopping, Killing, Exited},
+	Stopping:          {Killing, Exited},
+	Restarting:        {Killing, Exited},
+	Killing:           {Exited},
+	Exited:            {},
+}
+
+// lifecycleQueueSize is how many state changes may be waiting for each subscriber
+const lifecycleQueueSize = 16
+
+// StateChange is the server moving to State
+type StateChange struct {
+	State    State     `json:"state"`
+	Previous State     `json:"previous,omitempty"`
+	Time     time.Time `json:"time"`
+	Reason   string    `json:"reason,omitempty"`
+	// ExitCode is set once the server exited
+	ExitCode *int `json:"exitCode,omitempty"`
+}
+
+// Lifecycle tracks the state of the server process and publishes each change to its subscribers
+type Lifecycle struct {
+	logger *zap.Logger
+
+	mu          sync.Mutex
+	current     StateChange
+	subscribers map[int]chan StateChange
+	nextId      int
+}
+
+func NewLifecycle(logger *zap.Logger) *Lifecycle {
+	return &Lifecycle{
+		logger: logger,
+		current: StateChange{
+			State: Starting,
+			Time:  time.Now(),
+		},
+		subscribers: map[int]chan StateChange{},
+	}
+}
+
+// Current is the latest state change
+func (l *Lifecycle) Current() StateChange {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.current
+}
+
+// Set changes the state, if the current state allows it, and reports whether it changed
+func (l *Lifecycle) Set(state State, reason string) bool {
+	return l.change(StateChange{State: state, Reason: reason})
+}
+
+// SetExited changes the state to exited with the server's exit code
+func (l *Lifecycle) SetExited(exitCode int) {
+	l.change(StateChange{State: Exited, ExitCode: &exitCode})
+}
+
+func (l *Lifecycle) change(change StateChange) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	allowed := false
+	for _, next := range stateTransitions[l.current.State] {
+		if next == change.State {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		l.logger.Debug("Ignoring server state change",
+			zap.String("from", string(l.current.State)), zap.String("to", string(change.State)))
+		return false
+	}
+
+	change.Previous = l.current.State
+	change.Time = time.Now()
+	l.current = change
+	l.logger.Debug("Server state changed",
+		zap.String("from", string(change.Previous)), zap.String("to", string(change.State)),
+		zap.String("reason", change.Reason))
+
+	for id, subscriber := range l.subscribers {
+		select {
+		case subscriber <- change:
+		default:
+			l.logger.Warn("Dropping server state change for a subscriber that fell behind", zap.Int("subscriber", id))
+		}
+	}
+	return true
+}
+
+// Subscribe returns a channel receiving the current state and then each change, and a function
+// that ends the subscription and closes the channel
+func (l *Lifecycle) Subscribe() (<-chan StateChange, func()) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	id := l.nextId
+	l.nextId++
+	changes := make(chan StateChange, lifecycleQueueSize)
+	changes <- l.current
+	l.subscribers[id] = changes
+
+	var once sync.Once
+	return changes, func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			delete(l.subscribers, id)
+			close(changes)
+		})
+	}
+}
@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package supervisor
+
+import (
+	"os/exec"
+
+	"go.uber.org/zap"
+)
+
+func SetProcessGroup(cmd *exec.Cmd) {
+	// process groups are only managed on linux
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+func StartReaper(serverPid int, logger *zap.Logger) {
+	// does nothing on non-linux
+}
@@ -0,0 +1,112 @@
+package supervisor
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"go.uber.org/zap"
+	"golang.org/x/sys/unix"
+)
+
+// SetProcessGroup starts the server in its own process group, so it and everything it spawns
+// can be killed together
+func SetProcessGroup(cmd *exec.Cmd) {
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+}
+
+// killProcessGroup kills the server's whole process group
+func killProcessGroup(cmd *exec.Cmd) error {
+	err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	if err != nil {
+		// the group may be gone already, but make sure the server itself is
+		return cmd.Process.Kill()
+	}
+	return nil
+}
+
+// StartReaper makes the runner adopt processes orphaned by the server, as PID 1 would even
+// when the runner isn't PID 1, and reaps them once they exit.
+// The server itself and the runner's own children, such as rcon-cli, are left to whoever waits on them.
+func StartReaper(serverPid int, logger *zap.Logger) {
+	if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+		logger.Warn("Unable to become a subreaper, orphaned processes are only reaped when running as PID 1", zap.Error(err))
+	}
+
+	sigchld := make(chan os.Signal, 1)
+	signal.Notify(sigchld, syscall.SIGCHLD)
+	go func() {
+		for range sigchld {
+			reapOrphans(serverPid, logger)
+		}
+	}()
+}
+
+func reapOrphans(serverPid int, logger *zap.Logger) {
+	pid := os.Getpid()
+	pgrp := syscall.Getpgrp()
+
+	statFiles, err := filepath.Glob("/proc/[0-9]*/stat")
+	if err != nil {
+		logger.Error("Failed to list processes", zap.Error(err))
+		return
+	}
+	for _, statFile := range statFiles {
+		childPid, state, ppid, childPgrp, err := readProcessStat(statFile)
+		if err != nil {
+			// most likely the process exited and was reaped meanwhile
+			continue
+		}
+		// the runner's own children stay in its process group, unlike the server and its descendants
+		if ppid != pid || state != 'Z' || childPid == serverPid || childPgrp == pgrp {
+			continue
+		}
+
+		var status syscall.WaitStatus
+		reaped, err := syscall.Wait4(childPid, &status, syscall.WNOHANG, nil)
+		if err != nil {
+			logger.Debug("Failed to reap orphaned process", zap.Int("pid", childPid), zap.Error(err))
+		} else if reaped == childPid {
+			logger.Debug("Reaped orphaned process", zap.Int("pid", childPid), zap.Int("exitStatus", status.ExitStatus()))
+		}
+	}
+}
+
+// readProcessStat reads the pid, state, parent pid and process group from a /proc/<pid>/stat file
+func readProcessStat(statFile string) (pid int, state byte, ppid int, pgrp int, err error) {
+	content, err := os.ReadFile(statFile)
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	// the command name is in parentheses and may itself contain spaces and parentheses
+	nameEnd := bytes.LastIndexByte(content, ')')
+	nameStart := bytes.IndexByte(content, '(')
+	if nameStart < 0 || nameEnd < nameStart {
+		return 0, 0, 0, 0, fmt.Errorf("unexpected content in %s", statFile)
+	}
+	pid, err = strconv.Atoi(string(bytes.TrimSpace(content[:nameStart])))
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	fields := bytes.Fields(content[nameEnd+1:])
+	if len(fields) < 3 || len(fields[0]) != 1 {
+		return 0, 0, 0, 0, fmt.Errorf("unexpected content in %s", statFile)
+	}
+	ppid, err = strconv.Atoi(string(fields[1]))
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	pgrp, err = strconv.Atoi(string(fields[2]))
+	if err != nil {
+		return 0, 0, 0, 0, err
+	}
+	return pid, fields[0][0], ppid, pgrp, nil
+}
@@ -0,0 +1,68 @@
+package supervisor
+
+import (
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// StopStage is one step of escalating a stop that is taking too long
+type StopStage struct {
+	Signal syscall.Signal
+	// Wait is how long to give the server after the signal before the next stage
+	Wait time.Duration
+}
+
+var stopSignals = map[string]syscall.Signal{
+	"SIGTERM": syscall.SIGTERM,
+	"SIGINT":  syscall.SIGINT,
+	"SIGQUIT": syscall.SIGQUIT,
+	"SIGHUP":  syscall.SIGHUP,
+	"SIGKILL": syscall.SIGKILL,
+}
+
+// ParseStopEscalation parses stages such as "SIGTERM:30s" and "SIGQUIT:10s". Since SIGKILL always
+// ends the escalation, it may be given last without a wait.
+func ParseStopEscalation(entries []string) ([]StopStage, error) {
+	var stages []StopStage
+	for i, entry := range entries {
+		name, waitValue, hasWait := strings.Cut(entry, ":")
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if !strings.HasPrefix(name, "SIG") {
+			name = "SIG" + name
+		}
+		signal, ok := stopSignals[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown signal '%s', expected SIGTERM, SIGINT, SIGQUIT, SIGHUP or SIGKILL", name)
+		}
+		if signal == syscall.SIGKILL {
+			if i != len(entries)-1 {
+				return nil, fmt.Errorf("SIGKILL must be the last stage")
+			}
+			continue
+		}
+		if !hasWait {
+			return nil, fmt.Errorf("%s needs a wait, such as %s:30s", name, name)
+		}
+		wait, err := time.ParseDuration(strings.TrimSpace(waitValue))
+		if err != nil {
+			return nil, fmt.Errorf("invalid wait for %s: %w", name, err)
+		}
+		if wait <= 0 {
+			return nil, fmt.Errorf("wait for %s must be positive", name)
+		}
+		stages = append(stages, StopStage{Signal: signal, Wait: wait})
+	}
+	return stages, nil
+}
+
+// StopSignalName is the name of a signal that may be used to stop the server, such as SIGTERM
+func StopSignalName(signal syscall.Signal) string {
+	for name, s := range stopSignals {
+		if s == signal {
+			return name
+		}
+	}
+	return signal.String()
+}
@@ -0,0 +1,207 @@
+// Package supervisor starts the server process, tracks its lifecycle and stops it: first with
+// the server's own stop command, then by escalating through signals until the process is killed.
+package supervisor
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultStopCommand is the console command that stops a Minecraft server
+const DefaultStopCommand = "stop"
+
+// Options configure how a Supervisor starts and stops the server process. Only Stdin is required.
+type Options struct {
+	// Start starts the process. By default, it starts the process in its own process group.
+	Start func(cmd *exec.Cmd) error
+	// Clock defaults to RealClock
+	Clock Clock
+	// Lifecycle defaults to a new lifecycle, such as when no one else needs to see the states
+	// before the process starts
+	Lifecycle *Lifecycle
+	// Stdin is where the stop command is written to the server's console
+	Stdin io.Writer
+	// SendStop, when set, sends the stop command instead, such as through RCON.
+	// When it fails, the command is written to Stdin after all.
+	SendStop func(command string) error
+	// BeforeKill is called right before the process is killed for not stopping in time,
+	// such as to capture a thread dump
+	BeforeKill func(cmd *exec.Cmd, reason string)
+	Logger     *zap.Logger
+}
+
+// StopOptions configure one stop of the server
+type StopOptions struct {
+	// Command defaults to DefaultStopCommand
+	Command string
+	// Duration is how long the server has to stop after the command before escalating.
+	// Zero waits for the server indefinitely.
+	Duration time.Duration
+	// Escalation are the signals sent, in order, once Duration elapsed. The process is killed
+	// once they run out.
+	Escalation []StopStage
+}
+
+// Supervisor runs one server process
+type Supervisor struct {
+	cmd    *exec.Cmd
+	opts   Options
+	exited chan struct{}
+}
+
+// New supervises cmd, which has been set up but not started
+func New(cmd *exec.Cmd, opts Options) *Supervisor {
+	if opts.Start == nil {
+		opts.Start = func(cmd *exec.Cmd) error {
+			SetProcessGroup(cmd)
+			return cmd.Start()
+		}
+	}
+	if opts.Clock == nil {
+		opts.Clock = RealClock{}
+	}
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	if opts.Lifecycle == nil {
+		opts.Lifecycle = NewLifecycle(opts.Logger)
+	}
+	return &Supervisor{
+		cmd:    cmd,
+		opts:   opts,
+		exited: make(chan struct{}),
+	}
+}
+
+// Cmd is the supervised process
+func (s *Supervisor) Cmd() *exec.Cmd {
+	return s.cmd
+}
+
+// Lifecycle tracks the states of the supervised process
+func (s *Supervisor) Lifecycle() *Lifecycle {
+	return s.opts.Lifecycle
+}
+
+// Exited is closed once the process has exited
+func (s *Supervisor) Exited() <-chan struct{} {
+	return s.exited
+}
+
+// Start starts the process and moves the lifecycle to running
+func (s *Supervisor) Start() error {
+	if err := s.opts.Start(s.cmd); err != nil {
+		return err
+	}
+	s.opts.Lifecycle.Set(Running, "")
+	return nil
+}
+
+// Wait waits for the process to exit and moves the lifecycle to exited. It returns the exit code,
+// which is -1 when a signal ended the process, and the state the server was in before it exited.
+// An error is only returned when the process couldn't be waited on, in which case the exit code is 1.
+func (s *Supervisor) Wait() (int, State, error) {
+	waitErr := s.cmd.Wait()
+	stateBeforeExit := s.opts.Lifecycle.Current().State
+	close(s.exited)
+
+	exitCode := 0
+	if waitErr != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(waitErr, &exitErr) {
+			s.opts.Lifecycle.SetExited(1)
+			return 1, stateBeforeExit, waitErr
+		}
+		exitCode = exitErr.ExitCode()
+	}
+	s.opts.Lifecycle.SetExited(exitCode)
+	return exitCode, stateBeforeExit, nil
+}
+
+// Stop sends the stop command to the server and, once the stop duration elapsed, escalates
+// through the stop stages until the process is killed. It returns once the command was sent.
+func (s *Supervisor) Stop(opts StopOptions) {
+	logger := s.opts.Logger
+	stopCommand := opts.Command
+	if stopCommand == "" {
+		stopCommand = DefaultStopCommand
+	}
+	s.opts.Lifecycle.Set(Stopping, "")
+	if s.opts.SendStop != nil {
+		err := s.opts.SendStop(stopCommand)
+		if err != nil {
+			logger.Error("Failed to send stop command, writing it to the console instead", zap.Error(err))
+			s.stopViaConsole(stopCommand)
+		}
+	} else {
+		s.stopViaConsole(stopCommand)
+	}
+
+	logger.Info("Waiting for completion...")
+	if opts.Duration != 0 {
+		go s.escalate(opts.Duration, opts.Escalation)
+	}
+}
+
+func (s *Supervisor) stopViaConsole(stopCommand string) {
+	s.opts.Logger.Info("Sending '" + stopCommand + "' to Minecraft server...")
+	_, err := s.opts.Stdin.Write([]byte(stopCommand + "\n"))
+	if err != nil {
+		s.opts.Logger.Error("Failed to write stop command to server console", zap.Error(err))
+	}
+}
+
+// Kill kills the server's whole process group
+func (s *Supervisor) Kill() error {
+	return killProcessGroup(s.cmd)
+}
+
+// escalate gives the server stopDuration to stop after the stop command, then sends each
+// stage's signal in turn, and finally kills the process.
+// It returns early once the process exits.
+func (s *Supervisor) escalate(stopDuration time.Duration, stages []StopStage) {
+	logger := s.opts.Logger
+	waited := stopDuration
+	select {
+	case <-s.exited:
+		return
+	case <-s.opts.Clock.After(stopDuration):
+	}
+
+	for _, stage := range stages {
+		logger.Warn(fmt.Sprintf("Server still running %s after the stop command, sending %s", waited, StopSignalName(stage.Signal)),
+			zap.Duration("nextStageIn", stage.Wait))
+		if err := s.cmd.Process.Signal(stage.Signal); err != nil {
+			logger.Error("Failed to signal server process", zap.String("signal", StopSignalName(stage.Signal)), zap.Error(err))
+		}
+
+		select {
+		case <-s.exited:
+			logger.Info("Server stopped after " + StopSignalName(stage.Signal))
+			return
+		case <-s.opts.Clock.After(stage.Wait):
+		}
+		waited += stage.Wait
+	}
+
+	if s.opts.BeforeKill != nil {
+		s.opts.BeforeKill(s.cmd, fmt.Sprintf("server still running %s after the stop command", waited))
+	}
+	select {
+	case <-s.exited:
+		return
+	default:
+	}
+
+	logger.Error("Took too long, so killing server process", zap.Duration("waited", waited))
+	s.opts.Lifecycle.Set(Killing, fmt.Sprintf("still running %s after the stop command", waited))
+	err := s.Kill()
+	if err != nil {
+		logger.Error("Failed to forcefully kill process")
+	}
+}
@@ -0,0 +1,275 @@
+package supervisor_test
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/itzg/mc-server-runner/supervisor"
+	"github.com/itzg/mc-server-runner/supervisor/supervisortest"
+)
+
+// supervisorTestTimeout bounds how long each test waits on the process
+const supervisorTestTimeout = 10 * time.Second
+
+// advance waits for the supervisor to start a timer, then moves the clock forward
+func advance(t *testing.T, clock *supervisortest.Clock, d time.Duration) {
+	t.Helper()
+	if !clock.WaitForTimer(supervisorTestTimeout) {
+		t.Fatal("timed out waiting for the supervisor to start a timer")
+	}
+	clock.Advance(d)
+}
+
+type waitResult struct {
+	exitCode        int
+	stateBeforeExit supervisor.State
+	err             error
+}
+
+// startScript supervises a shell script and waits for it to print its first line, so that it has
+// set up its traps before the test stops it. The output comes through a pipe the test owns,
+// since Wait closes the pipes that exec.Cmd creates.
+func startScript(t *testing.T, script string, opts supervisor.Options) (*supervisor.Supervisor, <-chan waitResult, *bufio.Reader) {
+	t.Helper()
+	if runtime.GOOS != "linux" {
+		t.Skip("the server process is only supervised on linux")
+	}
+
+	cmd := exec.Command("sh", "-c", script)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, stdoutWriter, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { stdout.Close() })
+	cmd.Stdout = stdoutWriter
+	opts.Stdin = stdin
+
+	s := supervisor.New(cmd, opts)
+	err = s.Start()
+	stdoutWriter.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := s.Lifecycle().Current().State; state != supervisor.Running {
+		t.Errorf("expected %s once started, got %s", supervisor.Running, state)
+	}
+
+	output := bufio.NewReader(stdout)
+	if _, err := output.ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan waitResult, 1)
+	go func() {
+		exitCode, stateBeforeExit, err := s.Wait()
+		done <- waitResult{exitCode, stateBeforeExit, err}
+	}()
+	t.Cleanup(func() {
+		s.Kill()
+	})
+	return s, done, output
+}
+
+func waitForExit(t *testing.T, done <-chan waitResult) waitResult {
+	t.Helper()
+	select {
+	case result := <-done:
+		if result.err != nil {
+			t.Fatal(result.err)
+		}
+		return result
+	case <-time.After(supervisorTestTimeout):
+		t.Fatal("timed out waiting for the process to exit")
+		return waitResult{}
+	}
+}
+
+// stopsOnCommand exits with 0 once it reads the stop command, like a server does
+const stopsOnCommand = `echo ready; while read -r line; do echo "$line"; [ "$line" = "$STOP" ] && exit 0; done`
+
+func TestStopWritesCommandToStdin(t *testing.T) {
+	for _, command := range []string{"", "end"} {
+		expected := command
+		if expected == "" {
+			expected = supervisor.DefaultStopCommand
+		}
+		t.Setenv("STOP", expected)
+
+		s, done, _ := startScript(t, stopsOnCommand, supervisor.Options{})
+		s.Stop(supervisor.StopOptions{Command: command})
+		result := waitForExit(t, done)
+		if result.exitCode != 0 {
+			t.Errorf("expected exit code 0, got %d", result.exitCode)
+		}
+		if result.stateBeforeExit != supervisor.Stopping {
+			t.Errorf("expected to exit while %s, got %s", supervisor.Stopping, result.stateBeforeExit)
+		}
+		if state := s.Lifecycle().Current(); state.State != supervisor.Exited || *state.ExitCode != 0 {
+			t.Errorf("expected exited with 0, got %s", state.State)
+		}
+	}
+}
+
+func TestStopPrefersSendStop(t *testing.T) {
+	t.Setenv("STOP", supervisor.DefaultStopCommand)
+	sent := make(chan string, 2)
+	var sendFails atomic.Bool
+	s, done, output := startScript(t, stopsOnCommand, supervisor.Options{
+		SendStop: func(command string) error {
+			sent <- command
+			if sendFails.Load() {
+				return errors.New("rcon unavailable")
+			}
+			return nil
+		},
+	})
+
+	s.Stop(supervisor.StopOptions{})
+	if command := <-sent; command != supervisor.DefaultStopCommand {
+		t.Errorf("expected the stop command to be sent, got %q", command)
+	}
+	select {
+	case <-done:
+		t.Fatal("expected the console to not receive the stop command")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// a failed send falls back to the console
+	sendFails.Store(true)
+	s.Stop(supervisor.StopOptions{})
+	<-sent
+	if line, _ := output.ReadString('\n'); line != supervisor.DefaultStopCommand+"\n" {
+		t.Errorf("expected the console to receive the stop command once, got %q", line)
+	}
+	waitForExit(t, done)
+}
+
+func TestEscalationStopsAtSignalThatEndsProcess(t *testing.T) {
+	clock := &supervisortest.Clock{}
+	killed := make(chan string, 1)
+	s, done, _ := startScript(t, `trap "exit 3" TERM; echo ready; while :; do sleep 0.1; done`, supervisor.Options{
+		Clock:      clock,
+		BeforeKill: func(cmd *exec.Cmd, reason string) { killed <- reason },
+	})
+
+	s.Stop(supervisor.StopOptions{
+		Duration:   time.Minute,
+		Escalation: []supervisor.StopStage{{Signal: syscall.SIGTERM, Wait: time.Minute}},
+	})
+	advance(t, clock, time.Minute)
+
+	result := waitForExit(t, done)
+	if result.exitCode != 3 {
+		t.Errorf("expected the trap's exit code 3, got %d", result.exitCode)
+	}
+	if result.stateBeforeExit != supervisor.Stopping {
+		t.Errorf("expected to exit while %s, got %s", supervisor.Stopping, result.stateBeforeExit)
+	}
+	select {
+	case reason := <-killed:
+		t.Errorf("expected no kill, got %s", reason)
+	default:
+	}
+}
+
+func TestEscalationKillsProcessGroup(t *testing.T) {
+	clock := &supervisortest.Clock{}
+	killed := make(chan string, 1)
+	s, done, _ := startScript(t, `trap "" TERM INT; echo ready; while :; do sleep 0.1; done`, supervisor.Options{
+		Clock:      clock,
+		BeforeKill: func(cmd *exec.Cmd, reason string) { killed <- reason },
+	})
+
+	s.Stop(supervisor.StopOptions{
+		Duration: time.Minute,
+		Escalation: []supervisor.StopStage{
+			{Signal: syscall.SIGTERM, Wait: 30 * time.Second},
+			{Signal: syscall.SIGINT, Wait: 10 * time.Second},
+		},
+	})
+	advance(t, clock, time.Minute)
+	advance(t, clock, 30*time.Second)
+	select {
+	case <-done:
+		t.Fatal("exited before the last stage elapsed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	advance(t, clock, 10*time.Second)
+
+	result := waitForExit(t, done)
+	if result.exitCode != -1 {
+		t.Errorf("expected to be killed by a signal, got exit code %d", result.exitCode)
+	}
+	if result.stateBeforeExit != supervisor.Killing {
+		t.Errorf("expected to exit while %s, got %s", supervisor.Killing, result.stateBeforeExit)
+	}
+	if reason := <-killed; !strings.Contains(reason, "1m40s") {
+		t.Errorf("expected a kill after 1m40s, got %s", reason)
+	}
+}
+
+func TestStopWithoutDurationWaitsForServer(t *testing.T) {
+	clock := &supervisortest.Clock{}
+	s, done, _ := startScript(t, `trap "" TERM; echo ready; while :; do sleep 0.1; done`, supervisor.Options{Clock: clock})
+
+	s.Stop(supervisor.StopOptions{})
+	select {
+	case <-done:
+		t.Fatal("exited without being killed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if waiters := clock.Pending(); waiters != 0 {
+		t.Errorf("expected no escalation without a stop duration, got %d timers", waiters)
+	}
+}
+
+func TestParseStopEscalation(t *testing.T) {
+	tests := []struct {
+		entries  []string
+		expected []supervisor.StopStage
+		invalid  bool
+	}{
+		{nil, nil, false},
+		{[]string{"SIGTERM:30s", "quit:10s"}, []supervisor.StopStage{{syscall.SIGTERM, 30 * time.Second}, {syscall.SIGQUIT, 10 * time.Second}}, false},
+		{[]string{"SIGTERM:30s", "SIGKILL"}, []supervisor.StopStage{{syscall.SIGTERM, 30 * time.Second}}, false},
+		{[]string{"SIGKILL", "SIGTERM:30s"}, nil, true},
+		{[]string{"SIGTERM"}, nil, true},
+		{[]string{"SIGTERM:0s"}, nil, true},
+		{[]string{"SIGTERM:soon"}, nil, true},
+		{[]string{"SIGUSR1:10s"}, nil, true},
+	}
+	for _, tt := range tests {
+		stages, err := supervisor.ParseStopEscalation(tt.entries)
+		if tt.invalid {
+			if err == nil {
+				t.Errorf("expected %v to be invalid", tt.entries)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%v: %s", tt.entries, err)
+			continue
+		}
+		if len(stages) != len(tt.expected) {
+			t.Errorf("%v: expected %v, got %v", tt.entries, tt.expected, stages)
+			continue
+		}
+		for i := range stages {
+			if stages[i] != tt.expected[i] {
+				t.Errorf("%v: expected %v, got %v", tt.entries, tt.expected, stages)
+			}
+		}
+	}
+}
@@ -0,0 +1,100 @@
+// Package supervisortest provides a fake supervisor.Clock for tests of code that stops a server.
+package supervisortest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/itzg/mc-server-runner/supervisor"
+)
+
+// Clock only moves forward when the test advances it
+type Clock struct {
+	mu      sync.Mutex
+	now     time.Duration
+	waiters []*timer
+}
+
+var _ supervisor.Clock = (*Clock)(nil)
+
+type timer struct {
+	clock    *Clock
+	deadline time.Duration
+	fire     func()
+	stopped  bool
+}
+
+func (c *Clock) After(d time.Duration) <-chan time.Time {
+	fired := make(chan time.Time, 1)
+	c.AfterFunc(d, func() {
+		fired <- time.Now()
+	})
+	return fired
+}
+
+func (c *Clock) AfterFunc(d time.Duration, f func()) supervisor.Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &timer{clock: c, deadline: c.now + d, fire: f}
+	c.waiters = append(c.waiters, t)
+	return t
+}
+
+// Advance moves the clock forward and fires the timers that are due
+func (c *Clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now += d
+	var due []*timer
+	var pending []*timer
+	for _, t := range c.waiters {
+		if t.stopped {
+			continue
+		}
+		if t.deadline <= c.now {
+			t.stopped = true
+			due = append(due, t)
+		} else {
+			pending = append(pending, t)
+		}
+	}
+	c.waiters = pending
+	c.mu.Unlock()
+
+	for _, t := range due {
+		t.fire()
+	}
+}
+
+// Pending is the number of timers that haven't fired or been stopped
+func (c *Clock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	pending := 0
+	for _, t := range c.waiters {
+		if !t.stopped {
+			pending++
+		}
+	}
+	return pending
+}
+
+// WaitForTimer waits until a timer is pending, such as one started by another goroutine before the
+// test advances the clock, and reports false if none is within timeout
+func (c *Clock) WaitForTimer(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for c.Pending() == 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+func (t *timer) Stop() bool {
+	t.clock.mu.Lock()
+	defer t.clock.mu.Unlock()
+	wasPending := !t.stopped
+	t.stopped = true
+	return wasPending
+}
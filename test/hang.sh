@@ -0,0 +1,9 @@
+#!/bin/bash
+
+# This script hangs like a frozen server, ignoring the stop command, but prints a thread dump on SIGQUIT like the JVM
+
+trap 'echo "Full thread dump"' QUIT
+echo "Hanging..."
+while true; do
+  sleep 0.1
+done
@@ -0,0 +1,12 @@
+#!/bin/bash
+
+# This script stops like a server does, once it reads the stop command
+
+echo "Ready for commands..."
+while read -r line; do
+  echo "$line"
+  if [[ $line = stop ]]; then
+    echo "Stopping the server"
+    exit 0
+  fi
+done
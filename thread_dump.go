@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/itzg/mc-server-runner/hub"
+	"go.uber.org/zap"
+)
+
+const (
+	// jcmdTimeout limits how long jcmd may take to print the threads
+	jcmdTimeout = 30 * time.Second
+	// threadDumpQuietPeriod ends the capture of a SIGQUIT thread dump once the server stops printing
+	threadDumpQuietPeriod = 2 * time.Second
+	// threadDumpMaxCapture limits how long the output of a SIGQUIT thread dump is captured
+	threadDumpMaxCapture = 15 * time.Second
+	// threadDumpQueueSize bounds the output queued while capturing a SIGQUIT thread dump
+	threadDumpQueueSize = 16 * 1024 * 1024
+)
+
+// threadDumper saves JVM thread dumps of the server into timestamped files, using jcmd when
+// available or else capturing what the JVM prints on SIGQUIT. SIGQUIT is only sent when the server
+// process is java itself, since a shell or wrapper script would be stopped by it.
+type threadDumper struct {
+	dir string
+	// output is nil when the server's output isn't routed through the hub, in which case
+	// a SIGQUIT thread dump can only go to the console
+	output *hub.Hub
+	logger *zap.Logger
+}
+
+// Capture saves a thread dump of the server process and logs where it was saved.
+// A nil threadDumper does nothing, which is the case when thread dumps are disabled.
+func (d *threadDumper) Capture(cmd *exec.Cmd, reason string) {
+	if d == nil || cmd.Process == nil {
+		return
+	}
+
+	d.logger.Info("Capturing thread dump of the server", zap.String("reason", reason))
+	dump, err := d.jcmd(cmd.Process.Pid)
+	if err != nil {
+		if !isJavaProcess(cmd.Process.Pid) {
+			d.logger.Warn("Skipping thread dump, since jcmd is unavailable and the server process isn't java, which SIGQUIT would stop",
+				zap.Error(err))
+			return
+		}
+		d.logger.Debug("Unable to use jcmd for thread dump, using SIGQUIT instead", zap.Error(err))
+		dump, err = d.sigquit(cmd)
+	}
+	if err != nil {
+		d.logger.Error("Failed to capture thread dump", zap.Error(err))
+		return
+	}
+
+	dir := d.dir
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		d.logger.Error("Failed to create thread dump directory", zap.String("dir", dir), zap.Error(err))
+		return
+	}
+	filename := filepath.Join(dir, "thread-dump-"+time.Now().Format("20060102-150405")+".txt")
+	if err := os.WriteFile(filename, dump, 0644); err != nil {
+		d.logger.Error("Failed to save thread dump", zap.String("file", filename), zap.Error(err))
+		return
+	}
+	d.logger.Warn("Saved thread dump of the server", zap.String("file", filename), zap.String("reason", reason))
+}
+
+func (d *threadDumper) jcmd(pid int) ([]byte, error) {
+	jcmdPath, err := exec.LookPath("jcmd")
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), jcmdTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, jcmdPath, strconv.Itoa(pid), "Thread.print", "-l").Output()
+	if err != nil {
+		return nil, fmt.Errorf("jcmd failed: %w", err)
+	}
+	return out, nil
+}
+
+// isJavaProcess reports if the process runs the java executable, which prints its threads on SIGQUIT
+func isJavaProcess(pid int) bool {
+	exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+	if err != nil {
+		return false
+	}
+	return filepath.Base(exe) == "java"
+}
+
+// sigquit has the JVM print its threads and captures that output, until the server has been
+// quiet for a moment
+func (d *threadDumper) sigquit(cmd *exec.Cmd) ([]byte, error) {
+	if d.output == nil {
+		if err := cmd.Process.Signal(syscall.SIGQUIT); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("server output isn't captured, so the thread dump was only written to the console")
+	}
+
+	sub := d.output.Subscribe("thread dump", threadDumpQueueSize, hub.DropOldest)
+	defer sub.Unsubscribe()
+
+	if err := cmd.Process.Signal(syscall.SIGQUIT); err != nil {
+		return nil, err
+	}
+
+	lines := make(chan []byte)
+	go func() {
+		defer close(lines)
+		for {
+			chunk, ok := sub.Pop()
+			if !ok {
+				return
+			}
+			lines <- chunk.Data
+		}
+	}()
+
+	var dump bytes.Buffer
+	deadline := time.After(threadDumpMaxCapture)
+	quiet := time.NewTimer(threadDumpQuietPeriod)
+	defer quiet.Stop()
+Capture:
+	for {
+		select {
+		case line, ok := <-lines:
+			if !ok {
+				break Capture
+			}
+			dump.Write(line)
+			quiet.Reset(threadDumpQuietPeriod)
+		case <-quiet.C:
+			break Capture
+		case <-deadline:
+			break Capture
+		}
+	}
+	sub.Unsubscribe()
+	// let the goroutine above finish with the rest of the queue
+	for range lines {
+	}
+
+	if dump.Len() == 0 {
+		return nil, errors.New("server printed nothing after SIGQUIT")
+	}
+	return dump.Bytes(), nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// certReloadInterval is how often the certificate files are checked for changes
+const certReloadInterval = 10 * time.Second
+
+// certReloader serves a TLS certificate, and optionally a client CA pool, from files on disk and
+// picks up replacements of those files, such as when cert-manager rotates a mounted secret,
+// without restarting the listener.
+type certReloader struct {
+	logger       *zap.Logger
+	certFile     string
+	keyFile      string
+	clientCAFile string
+
+	mu        sync.RWMutex
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+	modTimes  map[string]time.Time
+}
+
+func newCertReloader(logger *zap.Logger, certFile string, keyFile string, clientCAFile string) (*certReloader, error) {
+	cr := &certReloader{
+		logger:       logger,
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+	}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *certReloader) files() []string {
+	files := []string{cr.certFile, cr.keyFile}
+	if cr.clientCAFile != "" {
+		files = append(files, cr.clientCAFile)
+	}
+	return files
+}
+
+func (cr *certReloader) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, file := range cr.files() {
+		fi, err := os.Stat(file)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %w", file, err)
+		}
+		modTimes[file] = fi.ModTime()
+	}
+
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if cr.clientCAFile != "" {
+		caContent, err := os.ReadFile(cr.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA file: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caContent) {
+			return errors.New("no certificates found in client CA file")
+		}
+	}
+
+	cr.mu.Lock()
+	cr.cert = &cert
+	cr.clientCAs = clientCAs
+	cr.modTimes = modTimes
+	cr.mu.Unlock()
+	return nil
+}
+
+func (cr *certReloader) changed() bool {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+
+	for _, file := range cr.files() {
+		fi, err := os.Stat(file)
+		if err != nil {
+			// likely mid-rotation, so check again on the next pass
+			continue
+		}
+		if !fi.ModTime().Equal(cr.modTimes[file]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch polls the certificate files until the context is done. A failed reload keeps
+// serving the previously loaded certificate.
+func (cr *certReloader) watch(ctx context.Context) {
+	ticker := time.NewTicker(certReloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !cr.changed() {
+				continue
+			}
+			if err := cr.load(); err != nil {
+				cr.logger.Error("Failed to reload TLS certificate, keeping previous one", zap.Error(err))
+			} else {
+				cr.logger.Info("Reloaded TLS certificate", zap.String("cert", cr.certFile))
+			}
+		}
+	}
+}
+
+// TLSConfig builds a server config that always presents the most recently loaded certificate
+// and, when a client CA file was given, requires clients to present a certificate signed by it.
+func (cr *certReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cr.mu.RLock()
+			defer cr.mu.RUnlock()
+
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cr.cert},
+			}
+			if cr.clientCAs != nil {
+				config.ClientCAs = cr.clientCAs
+				config.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return config, nil
+		},
+	}
+}
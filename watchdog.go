@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"time"
+
+	"github.com/itzg/mc-server-runner/hub"
+	"go.uber.org/zap"
+)
+
+const (
+	// watchdogProbeConsole sends a command to the console and waits for its response to be logged
+	watchdogProbeConsole = "console"
+	// watchdogProbeRcon sends the probe command with rcon-cli, or just connects to the RCON port
+	watchdogProbeRcon = "rcon"
+)
+
+// watchdogQueueSize bounds the server output queued between watchdog checks
+const watchdogQueueSize = 1024 * 1024
+
+// watchdogExitCode is the runner's exit code when the watchdog stopped the server and the server
+// then exited cleanly, so that the container is restarted
+const watchdogExitCode = 1
+
+var (
+	// overloadPattern matches the lines the server logs when it can't keep up with its ticks
+	overloadPattern = regexp.MustCompile(`(?i)can't keep up|server overloaded`)
+	// serverDonePattern matches the line logged once the server has started, which is when the
+	// watchdog starts probing unless a ready gate is configured
+	serverDonePattern = regexp.MustCompile(`Done \(`)
+)
+
+// watchdog periodically checks that the server is still responsive. After dumpAfter consecutive
+// failed checks it captures a thread dump, and after restartAfter it asks for the server to be
+// stopped, so the container's restart policy can start it again.
+type watchdog struct {
+	interval          time.Duration
+	timeout           time.Duration
+	probe             string
+	probeCommand      string
+	probePattern      *regexp.Regexp
+	overloadThreshold int
+	dumpAfter         int
+	restartAfter      int
+	healthFile        string
+
+	stdin  io.Writer
+	output *hub.Subscription
+	cmd    *exec.Cmd
+	dumper *threadDumper
+	// ready, when not nil, is closed once the server is ready for commands
+	ready  <-chan struct{}
+	logger *zap.Logger
+}
+
+func (w *watchdog) run(ctx context.Context, restart chan<- string) {
+	defer w.output.Unsubscribe()
+
+	lines := make(chan []byte)
+	go func() {
+		defer close(lines)
+		for {
+			chunk, ok := w.output.Pop()
+			if !ok {
+				return
+			}
+			select {
+			case lines <- chunk.Data:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	w.writeHealth("starting")
+	if !w.waitForStart(ctx, lines) {
+		return
+	}
+	w.logger.Info("Watchdog started", zap.Duration("interval", w.interval), zap.String("probe", w.probe))
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	failures := 0
+	overloads := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case line, ok := <-lines:
+			if !ok {
+				return
+			}
+			if overloadPattern.Match(line) {
+				overloads++
+			}
+			continue
+		case <-ticker.C:
+		}
+
+		err := w.check(ctx, lines, &overloads)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil && w.overloadThreshold > 0 && overloads >= w.overloadThreshold {
+			err = fmt.Errorf("server logged %d overload warnings since the last check", overloads)
+		}
+		overloads = 0
+
+		if err == nil {
+			if failures > 0 {
+				w.logger.Info("Server is responsive again", zap.Int("failedChecks", failures))
+			}
+			failures = 0
+			w.writeHealth("healthy")
+			continue
+		}
+
+		failures++
+		w.writeHealth("unhealthy: " + err.Error())
+		w.logger.Warn("Watchdog check failed", zap.Int("consecutiveFailures", failures), zap.Error(err))
+
+		if failures == w.dumpAfter {
+			w.dumper.Capture(w.cmd, fmt.Sprintf("watchdog check failed %d times", failures))
+		}
+		if failures == w.restartAfter {
+			restart <- fmt.Sprintf("watchdog check failed %d times: %s", failures, err)
+			return
+		}
+	}
+}
+
+// waitForStart waits until the ready gate opens or, without one, the server logs that it's done starting
+func (w *watchdog) waitForStart(ctx context.Context, lines <-chan []byte) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-w.ready:
+			return true
+		case line, ok := <-lines:
+			if !ok {
+				return false
+			}
+			if w.ready == nil && serverDonePattern.Match(line) {
+				return true
+			}
+		}
+	}
+}
+
+// check probes the server once. Lines logged while waiting are still checked for overload warnings.
+func (w *watchdog) check(ctx context.Context, lines <-chan []byte, overloads *int) error {
+	probeCtx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	switch w.probe {
+	case watchdogProbeRcon:
+		if rconEnabled() {
+			if err := rconClient().Command(probeCtx, w.probeCommand); err != nil {
+				return fmt.Errorf("rcon-cli failed: %w", err)
+			}
+			return nil
+		}
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(probeCtx, "tcp", rconClient().Address())
+		if err != nil {
+			return fmt.Errorf("RCON port not reachable: %w", err)
+		}
+		conn.Close()
+		return nil
+
+	default:
+		if _, err := w.stdin.Write([]byte(w.probeCommand + "\n")); err != nil {
+			return fmt.Errorf("unable to send probe command: %w", err)
+		}
+		for {
+			select {
+			case <-probeCtx.Done():
+				return fmt.Errorf("no response to '%s' within %s", w.probeCommand, w.timeout)
+			case line, ok := <-lines:
+				if !ok {
+					return errors.New("server output ended")
+				}
+				if overloadPattern.Match(line) {
+					*overloads++
+				}
+				if w.probePattern.Match(line) {
+					return nil
+				}
+			}
+		}
+	}
+}
+
+// writeHealth records the watchdog's view of the server, for use by a container health check
+func (w *watchdog) writeHealth(status string) {
+	if w.healthFile == "" {
+		return
+	}
+	if err := os.WriteFile(w.healthFile, []byte(status+"\n"), 0644); err != nil {
+		w.logger.Error("Failed to write watchdog health file", zap.String("file", w.healthFile), zap.Error(err))
+	}
+}
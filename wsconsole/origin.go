@@ -0,0 +1,181 @@
+package wsconsole
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// OriginPattern is a parsed entry of the allowed origins list, such as
+// "https://example.com", "https://*.example.com" or "http://localhost:*"
+type OriginPattern struct {
+	// exact is set instead of the other fields for an origin whose scheme has no default port,
+	// such as chrome-extension://id, which then has to match exactly
+	exact  string
+	scheme string
+	// host is lower-cased and, for a wildcard subdomain pattern, starts with "*."
+	host string
+	// port is either a number, or "*" to allow any port
+	port string
+}
+
+func defaultPortForScheme(scheme string) string {
+	switch scheme {
+	case "http", "ws":
+		return "80"
+	case "https", "wss":
+		return "443"
+	default:
+		return ""
+	}
+}
+
+// splitHostPortPattern is like net.SplitHostPort, but allows the port to be absent
+func splitHostPortPattern(hostPort string) (host string, port string, err error) {
+	if strings.HasPrefix(hostPort, "[") {
+		// IPv6 literal, such as [::1] or [::1]:8080
+		end := strings.Index(hostPort, "]")
+		if end < 0 {
+			return "", "", fmt.Errorf("missing ']' in host")
+		}
+		host = hostPort[1:end]
+		rest := hostPort[end+1:]
+		if rest == "" {
+			return host, "", nil
+		}
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", fmt.Errorf("unexpected characters after host")
+		}
+		return host, rest[1:], nil
+	}
+
+	if i := strings.LastIndex(hostPort, ":"); i >= 0 {
+		return hostPort[:i], hostPort[i+1:], nil
+	}
+	return hostPort, "", nil
+}
+
+func ParseOriginPattern(pattern string) (OriginPattern, error) {
+	scheme, hostPort, found := strings.Cut(strings.TrimSuffix(pattern, "/"), "://")
+	if !found || scheme == "" {
+		return OriginPattern{}, fmt.Errorf("origin '%s' must include a scheme, such as https://", pattern)
+	}
+	if strings.ContainsAny(hostPort, "/?#") {
+		return OriginPattern{}, fmt.Errorf("origin '%s' must not include a path", pattern)
+	}
+
+	host, port, err := splitHostPortPattern(hostPort)
+	if err != nil {
+		return OriginPattern{}, fmt.Errorf("origin '%s' is invalid: %w", pattern, err)
+	}
+	if host == "" {
+		return OriginPattern{}, fmt.Errorf("origin '%s' is missing a host", pattern)
+	}
+	scheme = strings.ToLower(scheme)
+	if port == "" && defaultPortForScheme(scheme) == "" {
+		return OriginPattern{exact: pattern}, nil
+	}
+	if strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+		return OriginPattern{}, fmt.Errorf("origin '%s' may only use a wildcard as the leftmost label, such as *.example.com", pattern)
+	}
+
+	switch port {
+	case "":
+		port = defaultPortForScheme(scheme)
+	case "*":
+	default:
+		if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+			return OriginPattern{}, fmt.Errorf("origin '%s' has an invalid port", pattern)
+		}
+	}
+
+	return OriginPattern{
+		scheme: scheme,
+		host:   strings.ToLower(host),
+		port:   port,
+	}, nil
+}
+
+// ParseOriginPatterns parses the configured allowed origins, skipping blank entries
+func ParseOriginPatterns(origins []string) ([]OriginPattern, error) {
+	var patterns []OriginPattern
+	for _, origin := range origins {
+		origin = strings.TrimSpace(origin)
+		if origin == "" {
+			continue
+		}
+		pattern, err := ParseOriginPattern(origin)
+		if err != nil {
+			return nil, err
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+func (p OriginPattern) matches(scheme string, host string, port string) bool {
+	if p.scheme != scheme {
+		return false
+	}
+	if p.port != "*" && p.port != port {
+		return false
+	}
+	if suffix, isWildcard := strings.CutPrefix(p.host, "*"); isWildcard {
+		// require at least one label in place of the wildcard
+		return len(host) > len(suffix) && strings.HasSuffix(host, suffix)
+	}
+	return p.host == host
+}
+
+// parseOrigin splits the value of an Origin header into its normalized scheme, host and port
+func parseOrigin(origin string) (scheme string, host string, port string, ok bool) {
+	u, err := url.Parse(origin)
+	if err != nil || u.Scheme == "" || u.Hostname() == "" {
+		return "", "", "", false
+	}
+	scheme = strings.ToLower(u.Scheme)
+	port = u.Port()
+	if port == "" {
+		port = defaultPortForScheme(scheme)
+	}
+	return scheme, strings.ToLower(u.Hostname()), port, true
+}
+
+func isOriginAllowed(origin string, allowedOrigins []OriginPattern) bool {
+	for _, pattern := range allowedOrigins {
+		if pattern.exact != "" && pattern.exact == origin {
+			return true
+		}
+	}
+	scheme, host, port, ok := parseOrigin(origin)
+	if !ok {
+		return false
+	}
+	for _, pattern := range allowedOrigins {
+		if pattern.exact == "" && pattern.matches(scheme, host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSameHostOrigin reports if the origin refers to the same host and port the request was sent to,
+// which is the case when the console page is served from behind the same address. The request host
+// is taken from the Host header, so this also works behind a reverse proxy that preserves it.
+// Since a DNS rebinding page controls both the origin and the Host header, this only proves the
+// page and the request share a name, not that the page is trusted, so it relies on authentication.
+func isSameHostOrigin(origin string, requestHost string) bool {
+	scheme, host, port, ok := parseOrigin(origin)
+	if !ok || (scheme != "http" && scheme != "https") {
+		return false
+	}
+
+	reqHost, reqPort, err := net.SplitHostPort(requestHost)
+	if err != nil {
+		reqHost = requestHost
+		reqPort = defaultPortForScheme(scheme)
+	}
+	return strings.EqualFold(strings.Trim(reqHost, "[]"), host) && reqPort == port
+}
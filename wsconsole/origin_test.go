@@ -0,0 +1,111 @@
+package wsconsole
+
+import "testing"
+
+func TestParseOriginPatternErrors(t *testing.T) {
+	invalid := []string{
+		"example.com",
+		"://example.com",
+		"https://",
+		"https://example.com/console",
+		"https://example.com:0",
+		"https://example.com:99999",
+		"https://example.com:abc",
+		"https://*",
+		"https://foo.*.example.com",
+		"https://*example.com",
+		"https://[::1",
+	}
+	for _, pattern := range invalid {
+		if _, err := ParseOriginPattern(pattern); err == nil {
+			t.Errorf("expected error parsing %q", pattern)
+		}
+	}
+}
+
+func TestParseOriginPatternsSkipsBlank(t *testing.T) {
+	patterns, err := ParseOriginPatterns([]string{"", " https://example.com ", ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(patterns) != 1 {
+		t.Fatalf("expected 1 pattern, got %d", len(patterns))
+	}
+}
+
+func TestIsOriginAllowed(t *testing.T) {
+	patterns, err := ParseOriginPatterns([]string{
+		"https://example.com",
+		"https://*.example.net",
+		"http://localhost:*",
+		"https://console.example.org:8443",
+		"http://[::1]:8080",
+		"HTTPS://Upper.Example.com/",
+		"chrome-extension://abcdefghijklmnop",
+		"custom://example.com:9000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"https://example.com", true},
+		{"https://example.com:443", true},
+		{"https://EXAMPLE.com", true},
+		{"http://example.com", false},
+		{"https://example.com:8443", false},
+		{"https://sub.example.com", false},
+		{"https://a.example.net", true},
+		{"https://a.b.example.net", true},
+		{"https://example.net", false},
+		{"https://evilexample.net", false},
+		{"http://a.example.net", false},
+		{"https://a.example.net:8443", false},
+		{"http://localhost", true},
+		{"http://localhost:3000", true},
+		{"https://localhost:3000", false},
+		{"https://console.example.org:8443", true},
+		{"https://console.example.org", false},
+		{"http://[::1]:8080", true},
+		{"http://[::1]:8081", false},
+		{"https://upper.example.com", true},
+		{"chrome-extension://abcdefghijklmnop", true},
+		{"chrome-extension://ponmlkjihgfedcba", false},
+		{"custom://example.com:9000", true},
+		{"custom://example.com:9001", false},
+		{"", false},
+		{"null", false},
+	}
+	for _, tt := range tests {
+		if got := isOriginAllowed(tt.origin, patterns); got != tt.allowed {
+			t.Errorf("isOriginAllowed(%q) = %v, want %v", tt.origin, got, tt.allowed)
+		}
+	}
+}
+
+func TestIsSameHostOrigin(t *testing.T) {
+	tests := []struct {
+		origin string
+		host   string
+		same   bool
+	}{
+		{"http://mc.example.com", "mc.example.com", true},
+		{"https://mc.example.com", "mc.example.com", true},
+		{"http://mc.example.com:8080", "mc.example.com:8080", true},
+		{"http://mc.example.com", "mc.example.com:80", true},
+		{"https://mc.example.com", "mc.example.com:80", false},
+		{"http://mc.example.com:8080", "mc.example.com", false},
+		{"http://other.example.com", "mc.example.com", false},
+		{"http://[::1]:8080", "[::1]:8080", true},
+		{"file://mc.example.com", "mc.example.com", false},
+		{"", "mc.example.com", false},
+	}
+	for _, tt := range tests {
+		if got := isSameHostOrigin(tt.origin, tt.host); got != tt.same {
+			t.Errorf("isSameHostOrigin(%q, %q) = %v, want %v", tt.origin, tt.host, got, tt.same)
+		}
+	}
+}
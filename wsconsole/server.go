@@ -0,0 +1,676 @@
+// Package wsconsole serves the server's console over websocket connections, authenticated by a password,
+// and sends each client the server's output and lifecycle states.
+package wsconsole
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/coder/websocket"
+	"github.com/coder/websocket/wsjson"
+	"github.com/google/uuid"
+	"github.com/itzg/mc-server-runner/hub"
+	"github.com/itzg/mc-server-runner/loginlimit"
+	"github.com/itzg/mc-server-runner/supervisor"
+	"go.uber.org/zap"
+)
+
+// Endpoint is the path of the console websocket
+const Endpoint = "/console"
+
+// ReloadEndpoint is the path that reloads the configuration when posted to
+const ReloadEndpoint = "/reload"
+
+// MessageType is the type of a JSON message exchanged with clients
+type MessageType string
+
+const (
+	// Client -> Server
+	MessageTypeStdin MessageType = "stdin"
+	// Server -> Client
+	MessageTypeStdout      MessageType = "stdout"
+	MessageTypeStderr      MessageType = "stderr"
+	MessageTypeLogHistory  MessageType = "logHistory"
+	MessageTypeAuthFailure MessageType = "authFailure"
+	MessageTypeState       MessageType = "state"
+)
+
+type wsMessage interface {
+	getType() string
+}
+
+type stdinMessage struct {
+	Type MessageType `json:"type"`
+	Data string      `json:"data"`
+}
+
+func (m stdinMessage) getType() string { return string(m.Type) }
+
+type stdoutMessage struct {
+	Type MessageType `json:"type"`
+	Data string      `json:"data"`
+	Seq  uint64      `json:"seq"`
+	Time time.Time   `json:"time"`
+}
+
+func (m stdoutMessage) getType() string { return string(m.Type) }
+
+type stderrMessage struct {
+	Type MessageType `json:"type"`
+	Data string      `json:"data"`
+	Seq  uint64      `json:"seq"`
+	Time time.Time   `json:"time"`
+}
+
+func (m stderrMessage) getType() string { return string(m.Type) }
+
+type logHistoryMessage struct {
+	Type  MessageType `json:"type"`
+	Lines []string    `json:"lines"`
+}
+
+func (m logHistoryMessage) getType() string { return string(m.Type) }
+
+type authFailureMessage struct {
+	Type   MessageType `json:"type"`
+	Reason string      `json:"reason"`
+}
+
+func (m authFailureMessage) getType() string { return string(m.Type) }
+
+type stateMessage struct {
+	Type     MessageType      `json:"type"`
+	State    supervisor.State `json:"state"`
+	Previous supervisor.State `json:"previous,omitempty"`
+	Time     time.Time        `json:"time"`
+	Reason   string           `json:"reason,omitempty"`
+	ExitCode *int             `json:"exitCode,omitempty"`
+}
+
+func (m stateMessage) getType() string { return string(m.Type) }
+
+type wsClient struct {
+	wsConn         *websocket.Conn
+	responseWriter http.ResponseWriter
+	request        http.Request
+	writeMutex     sync.Mutex
+	// queue holds the output waiting to be sent to this client by its sendRoutine
+	queue *hub.Subscription
+	// stateDone is closed once the stateRoutine has sent that the server exited, or gave up
+	stateDone chan struct{}
+}
+
+// Settings are the settings of a Server that may change while it runs
+type Settings struct {
+	// Password authenticates clients. When empty, no client is authenticated unless Options.DisableAuth.
+	Password            string
+	AllowedOrigins      []OriginPattern
+	AllowSameHostOrigin bool
+	// LogBufferSize is how many recent lines of output each new client receives
+	LogBufferSize int
+}
+
+// Options configure a Server
+type Options struct {
+	// Address is the host and port to listen on
+	Address            string
+	DisableAuth        bool
+	DisableOriginCheck bool
+	// TLSConfig, when set, serves the console over TLS
+	TLSConfig *tls.Config
+	// SendQueueSize and OverflowPolicy bound the output queued for each client
+	SendQueueSize  int
+	OverflowPolicy hub.OverflowPolicy
+	// Limiter, when set, applies login and session limits to clients
+	Limiter *loginlimit.Limiter
+	// Lifecycle, when set, is sent to clients as state messages
+	Lifecycle *supervisor.Lifecycle
+	// Reload, when set, serves ReloadEndpoint, which calls it and responds with the changed settings
+	Reload   func() ([]string, error)
+	Settings Settings
+	Logger   *zap.Logger
+}
+
+// Server relays console input from its clients to the server and sends them the server's output
+type Server struct {
+	logger     *zap.Logger
+	stdin      io.Writer
+	output     *hub.Hub
+	opts       Options
+	settings   atomic.Pointer[Settings]
+	logHistory *hub.LogRing
+
+	mu      sync.Mutex
+	clients map[uuid.UUID]*wsClient
+}
+
+// New creates a server that writes client input to stdin and sends the output of the hub to its clients
+func New(output *hub.Hub, stdin io.Writer, opts Options) *Server {
+	if opts.Logger == nil {
+		opts.Logger = zap.NewNop()
+	}
+	s := &Server{
+		logger:     opts.Logger,
+		stdin:      stdin,
+		output:     output,
+		opts:       opts,
+		logHistory: hub.NewLogRing(opts.Settings.LogBufferSize),
+		clients:    map[uuid.UUID]*wsClient{},
+	}
+	s.settings.Store(&opts.Settings)
+	return s
+}
+
+// UpdateSettings applies settings, such as after a configuration reload
+func (s *Server) UpdateSettings(settings Settings) {
+	s.settings.Store(&settings)
+	s.logHistory.Resize(settings.LogBufferSize)
+}
+
+func (s *Server) getWebsocketPassword() string {
+	return s.settings.Load().Password
+}
+
+func extractAuthTokenFromProtocols(header http.Header, expectedProto string) (string, bool) {
+	protoHeader := header.Get("Sec-WebSocket-Protocol")
+	if protoHeader == "" {
+		return "", false
+	}
+
+	protocols := strings.Split(protoHeader, ",")
+
+	for i, p := range protocols {
+		tp := strings.TrimSpace(p)
+
+		if tp == expectedProto {
+			if i+1 > len(protocols) {
+				return "", false
+			}
+			token := strings.TrimSpace(protocols[i+1])
+
+			if token != "" {
+				return token, true
+			}
+		}
+	}
+	return "", false
+}
+
+func (s *Server) isOriginAllowed(r *http.Request) bool {
+	current := s.settings.Load()
+	origin := r.Header.Get("Origin")
+	return isOriginAllowed(origin, current.AllowedOrigins) ||
+		(current.AllowSameHostOrigin && isSameHostOrigin(origin, r.Host))
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.opts.DisableOriginCheck && !s.isOriginAllowed(r) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusForbidden)
+
+		errMsg := authFailureMessage{
+			Type:   MessageTypeAuthFailure,
+			Reason: "origin not allowed",
+		}
+		json.NewEncoder(w).Encode(errMsg)
+		s.logger.Info(
+			"Websocket connection rejected",
+			zap.String("addr", r.RemoteAddr),
+			zap.String("reason", "origin not allowed"),
+		)
+		return
+	}
+
+	ip := loginlimit.RemoteIP(r.RemoteAddr)
+	if !s.opts.DisableAuth {
+		if allowed, retryAfter := s.opts.Limiter.Allow(ip); !allowed {
+			s.rejectTooManyRequests(w, r, "too many failed attempts", retryAfter)
+			return
+		}
+
+		// Authentication header should be extracted here. This is similar to how Minecraft's JSON-RPC over Websocket API works.
+		// expect string: "mc-server-runner-ws-v1, <TOKEN HERE>"
+		token, exists := extractAuthTokenFromProtocols(r.Header, "mc-server-runner-ws-v1")
+
+		password := s.getWebsocketPassword()
+		if !exists || password == "" || token != password {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+
+			errMsg := authFailureMessage{
+				Type:   MessageTypeAuthFailure,
+				Reason: "invalid password",
+			}
+			json.NewEncoder(w).Encode(errMsg)
+			s.logger.Info(
+				"Websocket connection rejected",
+				zap.String("addr", r.RemoteAddr),
+				zap.String("reason", "invalid password"),
+			)
+			s.opts.Limiter.RecordFailure(ip, "websocket")
+			return
+		}
+		s.opts.Limiter.RecordSuccess(ip)
+	}
+
+	if !s.opts.Limiter.AcquireSession(ip) {
+		s.rejectTooManyRequests(w, r, "too many sessions", 0)
+		return
+	}
+	defer s.opts.Limiter.ReleaseSession(ip)
+
+	c, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		s.logger.Error("websocket accept failed", zap.Error(err))
+		return
+	}
+	defer c.CloseNow()
+
+	s.mu.Lock()
+	sessionId := uuid.New()
+	client := &wsClient{
+		c,
+		w,
+		*r,
+		sync.Mutex{},
+		s.output.Subscribe("websocket "+sessionId.String(), s.opts.SendQueueSize, s.opts.OverflowPolicy),
+		make(chan struct{}),
+	}
+	s.clients[sessionId] = client
+	s.mu.Unlock()
+	defer client.queue.Unsubscribe()
+
+	s.logger.Info(
+		"Websocket connection opened",
+		zap.String("addr", r.RemoteAddr),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go heartbeatRoutine(ctx, s.logger, c, 30*time.Second)
+
+	client.writeMutex.Lock()
+	wsjson.Write(ctx, c, logHistoryMessage{
+		Type:  MessageTypeLogHistory,
+		Lines: s.logHistory.Lines(),
+	})
+	client.writeMutex.Unlock()
+	go s.sendRoutine(sessionId, client)
+	go s.stateRoutine(ctx, sessionId, client)
+
+	for {
+		if err = handleIncoming(c, s, ctx); err != nil {
+			s.logger.Debug("closing websocket session", zap.String("sessionId", sessionId.String()))
+			s.removeClient(sessionId)
+
+			closeStatus := websocket.CloseStatus(err)
+			switch closeStatus {
+			case websocket.StatusNormalClosure | websocket.StatusGoingAway:
+				s.logger.Info(
+					"Websocket connection closed",
+					zap.String("addr", r.RemoteAddr),
+					zap.Uint("code", uint(closeStatus)),
+					zap.String("reason", closeStatus.String()),
+				)
+				return
+			default:
+				s.logger.Error(
+					"failed to echo",
+					zap.String("addr", r.RemoteAddr),
+					zap.Uint("code", uint(closeStatus)),
+					zap.String("reason", closeStatus.String()),
+					zap.Error(err),
+				)
+				return
+			}
+		}
+	}
+}
+
+type reloadResponse struct {
+	Changed []string `json:"changed,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// handleReload reloads the configuration, like SIGHUP, for callers presenting the websocket
+// password as a bearer token
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	// Browsers always send an origin, so this keeps other websites from triggering reloads
+	if !s.opts.DisableOriginCheck && r.Header.Get("Origin") != "" && !s.isOriginAllowed(r) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(reloadResponse{Error: "origin not allowed"})
+		return
+	}
+
+	ip := loginlimit.RemoteIP(r.RemoteAddr)
+	if !s.opts.DisableAuth {
+		if allowed, retryAfter := s.opts.Limiter.Allow(ip); !allowed {
+			s.rejectTooManyRequests(w, r, "too many failed attempts", retryAfter)
+			return
+		}
+
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		password := s.getWebsocketPassword()
+		if !found || password == "" || subtle.ConstantTimeCompare([]byte(token), []byte(password)) != 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(reloadResponse{Error: "invalid password"})
+			s.logger.Info("Configuration reload rejected", zap.String("addr", r.RemoteAddr), zap.String("reason", "invalid password"))
+			s.opts.Limiter.RecordFailure(ip, "reload")
+			return
+		}
+		s.opts.Limiter.RecordSuccess(ip)
+	}
+
+	s.logger.Info("Reloading configuration", zap.String("addr", r.RemoteAddr))
+	changed, err := s.opts.Reload()
+	if err != nil {
+		s.logger.Error("Configuration reload rejected, keeping the previous configuration", zap.Error(err))
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(reloadResponse{Error: err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(reloadResponse{Changed: changed})
+}
+
+func (s *Server) rejectTooManyRequests(w http.ResponseWriter, r *http.Request, reason string, retryAfter time.Duration) {
+	w.Header().Set("Content-Type", "application/json")
+	if retryAfter > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Round(time.Second).Seconds())))
+	}
+	w.WriteHeader(http.StatusTooManyRequests)
+
+	errMsg := authFailureMessage{
+		Type:   MessageTypeAuthFailure,
+		Reason: reason,
+	}
+	json.NewEncoder(w).Encode(errMsg)
+	s.logger.Info(
+		"Websocket connection rejected",
+		zap.String("addr", r.RemoteAddr),
+		zap.String("reason", reason),
+	)
+}
+
+// heartbeatRoutine sends periodic pings and closes the connection if it fails.
+func heartbeatRoutine(ctx context.Context, logger *zap.Logger, c *websocket.Conn, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pingCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+
+			start := time.Now()
+			if err := c.Ping(pingCtx); err != nil {
+				logger.Warn("ping failed", zap.Error(err))
+				cancel()
+				c.CloseNow()
+				return
+			}
+			rtt := time.Since(start)
+			cancel()
+
+			logger.Debug("pong received", zap.Duration("rtt", rtt))
+		}
+	}
+}
+
+func handleIncoming(c *websocket.Conn, s *Server, ctx context.Context) error {
+	for {
+		typ, r, err := c.Reader(ctx)
+		if err != nil {
+			return err
+		}
+
+		if typ == websocket.MessageText {
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+
+			s.logger.Debug(fmt.Sprintf("Received raw data: %q\n", string(data)))
+
+			var msg stdinMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				s.logger.Warn(fmt.Sprintf("JSON parse error: %v\n", err))
+			} else {
+				s.logger.Debug(fmt.Sprintf("Successfully parsed JSON: %+v\n", msg))
+				switch msg.Type {
+				case MessageTypeStdin:
+					data := msg.Data
+					if !strings.HasSuffix(data, "\n") {
+						data += "\n"
+					}
+					s.stdin.Write([]byte(data))
+				default:
+					s.logger.Warn("unknown message type",
+						zap.String("type", string(msg.Type)),
+					)
+				}
+			}
+		}
+	}
+}
+
+func (s *Server) removeClient(id uuid.UUID) {
+	s.mu.Lock()
+	delete(s.clients, id)
+	s.mu.Unlock()
+}
+
+// sendRoutine writes the client's queued output to its connection until the queue is closed
+func (s *Server) sendRoutine(id uuid.UUID, client *wsClient) {
+	for {
+		chunk, ok := client.queue.Pop()
+		if !ok {
+			break
+		}
+
+		var message wsMessage
+		switch chunk.Target {
+		case hub.Stderr:
+			message = &stderrMessage{
+				Type: MessageTypeStderr,
+				Data: string(chunk.Data),
+				Seq:  chunk.Seq,
+				Time: chunk.Time,
+			}
+		default:
+			message = &stdoutMessage{
+				Type: MessageTypeStdout,
+				Data: string(chunk.Data),
+				Seq:  chunk.Seq,
+				Time: chunk.Time,
+			}
+		}
+
+		client.writeMutex.Lock()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err := wsjson.Write(ctx, client.wsConn, message)
+		cancel()
+		client.writeMutex.Unlock()
+
+		if err != nil {
+			s.logger.Error("failed to send message to client",
+				zap.String("client", id.String()),
+				zap.Error(err),
+			)
+			client.wsConn.Close(websocket.StatusInternalError, "closing client")
+			s.removeClient(id)
+			client.queue.Unsubscribe()
+			return
+		}
+	}
+
+	if client.queue.Overflowed() {
+		s.logger.Warn("Websocket client disconnected, too far behind on output",
+			zap.String("client", id.String()),
+			zap.String("addr", client.request.RemoteAddr),
+			zap.Uint64("totalDroppedBytes", s.output.DroppedBytes()),
+		)
+		s.removeClient(id)
+		client.wsConn.Close(websocket.StatusPolicyViolation, "client too slow")
+	} else if dropped := client.queue.Dropped(); dropped > 0 {
+		s.logger.Warn("Websocket client fell behind and missed output",
+			zap.String("client", id.String()),
+			zap.String("addr", client.request.RemoteAddr),
+			zap.Uint64("droppedBytes", dropped),
+			zap.Uint64("totalDroppedBytes", s.output.DroppedBytes()),
+		)
+	}
+}
+
+// stateRoutine sends the server's state, and then each change of it, to the client until ctx is done
+func (s *Server) stateRoutine(ctx context.Context, id uuid.UUID, client *wsClient) {
+	defer close(client.stateDone)
+	if s.opts.Lifecycle == nil {
+		return
+	}
+	changes, unsubscribe := s.opts.Lifecycle.Subscribe()
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case change := <-changes:
+			client.writeMutex.Lock()
+			writeCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+			err := wsjson.Write(writeCtx, client.wsConn, stateMessage{
+				Type:     MessageTypeState,
+				State:    change.State,
+				Previous: change.Previous,
+				Time:     change.Time,
+				Reason:   change.Reason,
+				ExitCode: change.ExitCode,
+			})
+			cancel()
+			client.writeMutex.Unlock()
+
+			if err != nil {
+				s.logger.Debug("failed to send state to client",
+					zap.String("client", id.String()),
+					zap.Error(err),
+				)
+				return
+			}
+			if change.State == supervisor.Exited {
+				return
+			}
+		}
+	}
+}
+
+// Run serves the console until ctx is done, and then lets each client know that the server
+// has stopped. It returns an error if the console couldn't be served.
+func (s *Server) Run(ctx context.Context) error {
+	logger := s.logger
+	l, err := net.Listen("tcp", s.opts.Address)
+	if err != nil {
+		return fmt.Errorf("failed to setup websocket server on %s: %w", s.opts.Address, err)
+	}
+	scheme := "ws"
+	if s.opts.TLSConfig != nil {
+		l = tls.NewListener(l, s.opts.TLSConfig)
+		scheme = "wss"
+	}
+	historySub := s.output.Subscribe("websocket log history", s.opts.SendQueueSize, hub.DropOldest)
+	defer historySub.Unsubscribe()
+	go func() {
+		for {
+			chunk, ok := historySub.Pop()
+			if !ok {
+				return
+			}
+			s.logHistory.Add(string(chunk.Data))
+		}
+	}()
+	logger.Info(fmt.Sprintf("Starting websocket server on %s://%v%v", scheme, l.Addr(), Endpoint))
+	if s.opts.DisableAuth {
+		logger.Warn("Websocket authentication is DISABLED. The websocket endpoint is unprotected and will accept commands from any client. This is insecure and not recommended for production.")
+	}
+	if s.opts.DisableOriginCheck {
+		logger.Warn("Origin check is DISABLED. The server will accept connections from browsers on ANY website, making it vulnerable to Cross-Site WebSocket Hijacking (CSWSH).")
+	}
+	if s.opts.DisableAuth && !s.opts.DisableOriginCheck && s.settings.Load().AllowSameHostOrigin {
+		logger.Warn("Same-host origins are allowed without authentication. A website can pass the origin check through DNS rebinding, so use a password or a reverse proxy that only forwards known hosts.")
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(Endpoint, s)
+	if s.opts.Reload != nil {
+		mux.HandleFunc("POST "+ReloadEndpoint, s.handleReload)
+	}
+
+	httpServer := &http.Server{
+		Handler:      mux,
+		ReadTimeout:  time.Second * 10,
+		WriteTimeout: time.Second * 10,
+	}
+
+	serveErrChan := make(chan error, 1)
+	go func() {
+		serveErrChan <- httpServer.Serve(l)
+	}()
+
+	var runErr error
+	select {
+	case serveErr := <-serveErrChan:
+		if !errors.Is(serveErr, http.ErrServerClosed) {
+			runErr = fmt.Errorf("failed to serve websocket server: %w", serveErr)
+		}
+	case <-ctx.Done():
+	}
+
+	timedCtx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	logger.Debug("Rejecting new ws connections...")
+	shutdownErrChan := make(chan error)
+	go func() {
+		shutdownErrChan <- httpServer.Shutdown(timedCtx)
+	}()
+
+	logger.Debug("Sending 1001 going away to all clients...")
+	s.mu.Lock()
+	clientsToClose := make(map[uuid.UUID]*wsClient, len(s.clients))
+	maps.Copy(clientsToClose, s.clients)
+	s.mu.Unlock()
+
+	for id, client := range clientsToClose {
+		go func(clientId uuid.UUID, clientConn *wsClient) {
+			// let the client know the server exited before closing
+			select {
+			case <-clientConn.stateDone:
+			case <-time.After(time.Second):
+			}
+			_ = clientConn.wsConn.Close(websocket.StatusGoingAway, "Server has stopped")
+		}(id, client)
+	}
+
+	if shutdownErr := <-shutdownErrChan; shutdownErr != nil {
+		logger.Error("failed to shutdown server", zap.Error(shutdownErr))
+	}
+	logger.Debug("Websocket server shut down complete.")
+	return runErr
+}